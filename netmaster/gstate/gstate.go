@@ -16,8 +16,18 @@ limitations under the License.
 package gstate
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"math/bits"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/jainvipin/bitset"
 
@@ -35,50 +45,581 @@ const (
 	operGlobalPrefix    = mastercfg.StateOperPath + "global/"
 	operGlobalPath      = operGlobalPrefix + "global"
 	vxlanLocalVlanRange = "1-4094"
+	defaultThresholdPct = 10
+	// upper bounds of the vlan and vxlan ids, as enforced by ParseTagRanges
+	maxVLANQuota  = 4094
+	maxVXLANQuota = 65535
+	// number of free local vlans reported by LocalVLANRange
+	localVLANSampleSize = 10
+	// ranges used by ConfigBuilder unless overridden, as in the default
+	// global config created by netmaster
+	defaultVLANRange  = "1-4094"
+	defaultVXLANRange = "1-10000"
 )
 
+// CfgKey returns the key under which the global config is stored.
+func CfgKey() string {
+	return cfgGlobalPath
+}
+
+// OperKey returns the key under which the global oper state is stored.
+func OperKey() string {
+	return operGlobalPath
+}
+
+// Errors returned by the allocation methods. They may be wrapped with more
+// context, so callers should test for them with errors.Is.
+var (
+	// ErrVLANUnavailable is returned when a requested vlan is already in use.
+	ErrVLANUnavailable = resources.ErrVLANUnavailable
+	// ErrVLANExhausted is returned when no vlans are left to allocate.
+	ErrVLANExhausted = resources.ErrVLANExhausted
+	// ErrVXLANUnavailable is returned when a requested vxlan is already in use.
+	ErrVXLANUnavailable = resources.ErrVXLANUnavailable
+	// ErrVXLANExhausted is returned when no vxlans are left to allocate.
+	ErrVXLANExhausted = resources.ErrVXLANExhausted
+	// ErrLocalVLANExhausted is returned when no local vlans are left to map
+	// a vxlan to.
+	ErrLocalVLANExhausted = resources.ErrLocalVLANExhausted
+	// ErrLocalVLANUnavailable is returned when a requested local vlan is
+	// already in use.
+	ErrLocalVLANUnavailable = resources.ErrLocalVLANUnavailable
+	// ErrVXLANOutOfRange is returned for a vxlan outside the configured range.
+	ErrVXLANOutOfRange = errors.New("Requested vxlan is out of range")
+	// ErrQuotaExceeded is returned when an allocation would exceed the
+	// configured Quota.
+	ErrQuotaExceeded = errors.New("Allocation quota exceeded")
+	// ErrConflict is returned by WriteIfUnchanged when the stored config was
+	// changed by someone else.
+	ErrConflict = errors.New("Global config was modified concurrently")
+	// ErrNilStateDriver is returned when the state is used without a state
+	// driver.
+	ErrNilStateDriver = errors.New("State driver is not set")
+)
+
+// cfgWriteMutex serializes the read and write of WriteIfUnchanged.
+var cfgWriteMutex sync.Mutex
+
+// tagRangeCache holds the parsed vlan and vxlan ranges, keyed by tag type
+// and range string.
+var tagRangeCache sync.Map
+
+// parseTagRanges parses the ranges, reusing the result of earlier calls.
+func parseTagRanges(ranges, tagType string) ([]netutils.TagRange, error) {
+	if ranges == "" {
+		// netutils.ParseTagRanges reports an empty config as range 0-0
+		return []netutils.TagRange{}, nil
+	}
+
+	key := tagType + "/" + ranges
+	if cached, ok := tagRangeCache.Load(key); ok {
+		return append([]netutils.TagRange(nil), cached.([]netutils.TagRange)...), nil
+	}
+
+	tagRanges, err := netutils.ParseTagRanges(ranges, tagType)
+	if err != nil {
+		return nil, err
+	}
+	tagRangeCache.Store(key, tagRanges)
+
+	return append([]netutils.TagRange(nil), tagRanges...), nil
+}
+
+// VLANRanges returns the parsed vlan ranges of the config, empty if no vlans
+// are configured.
+func (gc *Cfg) VLANRanges() ([]netutils.TagRange, error) {
+	return parseTagRanges(gc.Auto.VLANs, "vlan")
+}
+
+// VXLANRanges returns the parsed vxlan ranges of the config, empty if no
+// vxlans are configured.
+func (gc *Cfg) VXLANRanges() ([]netutils.TagRange, error) {
+	return parseTagRanges(gc.Auto.VXLANs, "vxlan")
+}
+
+// Logger is the leveled, printf style logger used by this package.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// logger is the package logger, the standard logrus logger by default.
+var logger Logger = log.StandardLogger()
+
+// SetLogger routes the package's logs, including the debug logs of every
+// allocation and release, to l. A nil l restores the default logger.
+func SetLogger(l Logger) {
+	if l == nil {
+		l = log.StandardLogger()
+	}
+	logger = l
+}
+
+// timeNow returns the current time; tests may override it.
+var timeNow = time.Now
+
+// allocMutex serializes the allocation and release of vlans and vxlans within
+// this process; read-only queries take the read lock.
+var allocMutex sync.RWMutex
+
+// pendingCallbacks are the hooks queued while allocMutex is held, run by
+// unlockAlloc once it is released so they may call back into the package.
+var pendingCallbacks []func()
+
+// unlockAlloc releases allocMutex and then runs the queued hooks.
+func unlockAlloc() {
+	pending := pendingCallbacks
+	pendingCallbacks = nil
+	allocMutex.Unlock()
+
+	for _, fn := range pending {
+		fn()
+	}
+}
+
 // AutoParams specifies various parameters for the auto allocation and resource
 // management for networks and endpoints.  This allows for hands-free
 // allocation of resources without having to specify these each time these
-// constructs gets created.
+// constructs gets created. Empty fields are left out of the stored state;
+// keys are matched case-insensitively on read, so state written with the
+// older "VLANs"/"VXLANs" keys still loads.
 type AutoParams struct {
-	VLANs  string `json:"VLANs"`
-	VXLANs string `json:"VXLANs"`
+	VLANs  string `json:"vlans,omitempty"`
+	VXLANs string `json:"vxlans,omitempty"`
+
+	// ReservedVLANs are never allocated, as vlans or as the local vlans of
+	// vxlans, in addition to vlans 0 and 4095.
+	ReservedVLANs []uint `json:"reservedVLANs,omitempty"`
+}
+
+// Quota caps the number of vlans and vxlans that may be allocated at a time,
+// even if the pools have more. Zero means unlimited.
+type Quota struct {
+	MaxVLANs  uint `json:"maxVLANs,omitempty"`
+	MaxVXLANs uint `json:"maxVXLANs,omitempty"`
 }
 
 // Cfg is the configuration of a tenant.
 type Cfg struct {
 	core.CommonState
-	Auto AutoParams `json:"auto"`
+	Auto  AutoParams `json:"auto"`
+	Quota Quota      `json:"quota"`
+
+	// TrackAllocationTime records in Oper when each vlan and vxlan was
+	// allocated, for finding leaked allocations with OldestAllocation.
+	TrackAllocationTime bool `json:"trackAllocationTime,omitempty"`
+
+	// OnThreshold, if set, is called with the resource ("vlan" or "vxlan")
+	// and its free percentage after an allocation leaves less than
+	// ThresholdPct (10 by default) percent of the pool free. It is called
+	// once the allocation has released its lock.
+	OnThreshold  func(resource string, pct float64) `json:"-"`
+	ThresholdPct float64                            `json:"-"`
+
+	// Observer, if set, is notified of every vlan and vxlan allocated or
+	// freed through this config, once the allocation lock is released.
+	Observer Observer `json:"-"`
+
+	// Serializer, if set, replaces JSON as the encoding of the stored state.
+	Serializer *Serializer `json:"-"`
+}
+
+// Serializer provides the functions used to encode and decode the state
+// written to the state driver.
+type Serializer struct {
+	Marshal   func(interface{}) ([]byte, error)
+	Unmarshal func([]byte, interface{}) error
+}
+
+// jsonSerializer is the default encoding of the state.
+var jsonSerializer = &Serializer{Marshal: json.Marshal, Unmarshal: json.Unmarshal}
+
+// serializerOrDefault returns s, or the JSON serializer if s is nil.
+func serializerOrDefault(s *Serializer) *Serializer {
+	if s == nil {
+		return jsonSerializer
+	}
+
+	return s
+}
+
+// EventOp is the operation an Event reports.
+type EventOp string
+
+const (
+	// EventAlloc reports an allocation.
+	EventAlloc EventOp = "alloc"
+	// EventFree reports a release.
+	EventFree EventOp = "free"
+)
+
+// Event describes a vlan or vxlan being allocated or freed.
+type Event struct {
+	Resource  string // "vlan" or "vxlan"
+	Op        EventOp
+	Value     uint
+	LocalVLAN uint // set for vxlan events only
+}
+
+// Observer is notified of allocation events, e.g. to program switches.
+type Observer interface {
+	Notify(ev Event)
 }
 
 // Oper encapsulates operations on a tenant.
 type Oper struct {
 	core.CommonState
-	DefaultNetwork  string `json:"defaultNetwork"`
-	FreeVXLANsStart uint   `json:"freeVXLANsStart"`
+	DefaultNetwork  string `json:"defaultNetwork,omitempty"`
+	FreeVXLANsStart uint   `json:"freeVXLANsStart,omitempty"`
+	VXLANRangeMin   uint   `json:"vxlanRangeMin,omitempty"`
+	VXLANRangeMax   uint   `json:"vxlanRangeMax,omitempty"`
+
+	// VXLANLocalVLANs maps each allocated vxlan to its local vlan.
+	VXLANLocalVLANs map[uint]uint `json:"vxlanLocalVLANs,omitempty"`
+
+	// ReservedVXLANs records the vxlans reserved with SetVXLAN, which have
+	// no local vlan.
+	ReservedVXLANs map[uint]bool `json:"reservedVXLANs,omitempty"`
+
+	// AllocatedAt records when each vlan or vxlan was allocated, keyed by
+	// "vlan/<id>" or "vxlan/<id>", if the config tracks allocation times.
+	AllocatedAt map[string]time.Time `json:"allocatedAt,omitempty"`
+
+	// VLANLeases records the expiry of each vlan allocated with a TTL.
+	VLANLeases map[uint]time.Time `json:"vlanLeases,omitempty"`
+
+	// Serializer, if set, replaces JSON as the encoding of the stored state.
+	Serializer *Serializer `json:"-"`
+}
+
+// LocalVLANRange reports the local vlan pool backing the vxlans: the number
+// of free local vlans and the first few of them.
+func (g *Oper) LocalVLANRange() (freeCount uint, sample []uint, err error) {
+	allocMutex.RLock()
+	defer allocMutex.RUnlock()
+
+	gc := &Cfg{CommonState: g.CommonState}
+	oper, err := gc.readVXLANOper()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	sample = []uint{}
+	for vlan, found := oper.FreeLocalVLANs.NextSet(0); found &&
+		len(sample) < localVLANSampleSize; vlan, found = oper.FreeLocalVLANs.NextSet(vlan + 1) {
+		sample = append(sample, vlan)
+	}
+
+	return oper.FreeLocalVLANs.Count(), sample, nil
+}
+
+// Metric is a pool utilization sample, e.g. for exporting as a gauge.
+type Metric struct {
+	Name   string
+	Labels map[string]string
+	Value  float64
+}
+
+// CollectMetrics returns the free and total counts of the vlan, local vlan
+// and vxlan pools, labeled by pool. Pools that are not defined are skipped.
+func (g *Oper) CollectMetrics() []Metric {
+	allocMutex.RLock()
+	defer allocMutex.RUnlock()
+
+	metrics := []Metric{}
+	add := func(pool string, free, total uint) {
+		labels := map[string]string{"pool": pool}
+		metrics = append(metrics,
+			Metric{Name: "netplugin_pool_free", Labels: labels, Value: float64(free)},
+			Metric{Name: "netplugin_pool_total", Labels: labels, Value: float64(total)})
+	}
+
+	gc := &Cfg{CommonState: g.CommonState}
+	if vlanCfg, err := gc.readVLANCfg(); err == nil {
+		if vlanOper, err := gc.readVLANOper(); err == nil {
+			add("vlan", vlanOper.FreeVLANs.Count(), vlanCfg.VLANs.Count())
+		}
+	}
+	if vxlanCfg, err := gc.readVXLANCfg(); err == nil {
+		if vxlanOper, err := gc.readVXLANOper(); err == nil {
+			add("localvlan", vxlanOper.FreeLocalVLANs.Count(), vxlanCfg.LocalVLANs.Count())
+			add("vxlan", vxlanOper.FreeVXLANs.Count(), vxlanCfg.VXLANs.Count())
+		}
+	}
+
+	return metrics
+}
+
+// SelfCheck verifies the invariants of the global and resource state and
+// returns the inconsistencies found, e.g. for alerting before allocations
+// start failing.
+func (g *Oper) SelfCheck() []string {
+	allocMutex.RLock()
+	defer allocMutex.RUnlock()
+
+	problems := []string{}
+	gc := &Cfg{CommonState: g.CommonState}
+
+	if vlanCfg, err := gc.readVLANCfg(); err == nil {
+		if vlanCfg.VLANs.Test(0) || vlanCfg.VLANs.Test(4095) {
+			problems = append(problems, "reserved vlan 0 or 4095 is in the vlan pool")
+		}
+		vlanOper, err := gc.readVLANOper()
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("unable to read vlan oper state: %s", err))
+		} else if n := vlanOper.FreeVLANs.DifferenceCardinality(vlanCfg.VLANs); n != 0 {
+			problems = append(problems, fmt.Sprintf("%d free vlans are outside the vlan pool", n))
+		}
+	} else if core.ErrIfKeyExists(err) != nil {
+		problems = append(problems, fmt.Sprintf("unable to read vlan config: %s", err))
+	}
+
+	vxlanCfg, err := gc.readVXLANCfg()
+	if err != nil {
+		if core.ErrIfKeyExists(err) != nil {
+			problems = append(problems, fmt.Sprintf("unable to read vxlan config: %s", err))
+		}
+		return problems
+	}
+
+	if vxlanCfg.LocalVLANs.Test(0) || vxlanCfg.LocalVLANs.Test(4095) {
+		problems = append(problems, "reserved vlan 0 or 4095 is in the local vlan pool")
+	}
+	if vxlanCfg.VXLANs.Test(0) {
+		problems = append(problems, fmt.Sprintf("vxlan %d is below the vxlan range", g.FreeVXLANsStart))
+	}
+	if g.VXLANRangeMax != 0 && g.VXLANRangeMax != g.FreeVXLANsStart+vxlanCfg.VXLANs.Len()-1 {
+		problems = append(problems, fmt.Sprintf("vxlan range %d-%d does not match the vxlan pool size %d",
+			g.VXLANRangeMin, g.VXLANRangeMax, vxlanCfg.VXLANs.Len()))
+	}
+
+	vxlanOper, err := gc.readVXLANOper()
+	if err != nil {
+		return append(problems, fmt.Sprintf("unable to read vxlan oper state: %s", err))
+	}
+	if n := vxlanOper.FreeVXLANs.DifferenceCardinality(vxlanCfg.VXLANs); n != 0 {
+		problems = append(problems, fmt.Sprintf("%d free vxlans are outside the vxlan pool", n))
+	}
+	if n := vxlanOper.FreeLocalVLANs.DifferenceCardinality(vxlanCfg.LocalVLANs); n != 0 {
+		problems = append(problems, fmt.Sprintf("%d free local vlans are outside the local vlan pool", n))
+	}
+	used := vxlanCfg.VXLANs.Difference(vxlanOper.FreeVXLANs)
+	for idx, ok := used.NextSet(0); ok; idx, ok = used.NextSet(idx + 1) {
+		vxlan := idx + g.FreeVXLANsStart
+		if _, mapped := g.VXLANLocalVLANs[vxlan]; !mapped && !g.ReservedVXLANs[vxlan] {
+			problems = append(problems, fmt.Sprintf("allocated vxlan %d has no local vlan recorded", vxlan))
+		}
+	}
+	for vxlan, localVLAN := range g.VXLANLocalVLANs {
+		if vxlan <= g.FreeVXLANsStart || vxlanOper.FreeVXLANs.Test(vxlan-g.FreeVXLANsStart) {
+			problems = append(problems, fmt.Sprintf("mapped vxlan %d is not allocated", vxlan))
+		}
+		if vxlanOper.FreeLocalVLANs.Test(localVLAN) {
+			problems = append(problems, fmt.Sprintf("local vlan %d of vxlan %d is not allocated",
+				localVLAN, vxlan))
+		}
+	}
+	sort.Strings(problems)
+
+	return problems
+}
+
+// Clone returns a copy of the oper state sharing the same state driver. The
+// free pools are kept by the vlan and vxlan resources, so there are no
+// bitsets to copy here.
+func (g *Oper) Clone() *Oper {
+	clone := *g
+	if g.VXLANLocalVLANs != nil {
+		clone.VXLANLocalVLANs = make(map[uint]uint, len(g.VXLANLocalVLANs))
+		for vxlan, localVLAN := range g.VXLANLocalVLANs {
+			clone.VXLANLocalVLANs[vxlan] = localVLAN
+		}
+	}
+	if g.ReservedVXLANs != nil {
+		clone.ReservedVXLANs = make(map[uint]bool, len(g.ReservedVXLANs))
+		for vxlan := range g.ReservedVXLANs {
+			clone.ReservedVXLANs[vxlan] = true
+		}
+	}
+	if g.AllocatedAt != nil {
+		clone.AllocatedAt = make(map[string]time.Time, len(g.AllocatedAt))
+		for key, allocatedAt := range g.AllocatedAt {
+			clone.AllocatedAt[key] = allocatedAt
+		}
+	}
+	if g.VLANLeases != nil {
+		clone.VLANLeases = make(map[uint]time.Time, len(g.VLANLeases))
+		for vlan, expiry := range g.VLANLeases {
+			clone.VLANLeases[vlan] = expiry
+		}
+	}
+
+	return &clone
+}
+
+// inVXLANRange checks if the vxlan falls within the configured span. State
+// written before the range was recorded only has a lower bound.
+func (g *Oper) inVXLANRange(vxlan uint) bool {
+	if g.VXLANRangeMax == 0 {
+		return vxlan > g.FreeVXLANsStart
+	}
+
+	return vxlan >= g.VXLANRangeMin && vxlan <= g.VXLANRangeMax
 }
 
 // Dump is a debugging utility.
 func (gc *Cfg) Dump() error {
-	log.Debugf("Global State %v \n", gc)
+	out, err := gc.DumpJSON()
+	if err != nil {
+		logger.Debugf("Global State %v \n", gc)
+		return nil
+	}
+
+	logger.Debugf("Global State %s \n", out)
 	return nil
 }
 
+// DumpJSON returns the global configuration as JSON.
+func (gc *Cfg) DumpJSON() ([]byte, error) {
+	return json.Marshal(gc)
+}
+
+// operDump is the machine readable form of the global oper state.
+type operDump struct {
+	DefaultNetwork  string `json:"defaultNetwork"`
+	FreeVXLANsStart uint   `json:"freeVXLANsStart"`
+	FreeVLANs       uint   `json:"freeVLANs"`
+	FreeVXLANs      uint   `json:"freeVXLANs"`
+}
+
+// DumpJSON returns the global oper state as JSON, reporting the number of
+// free vlans and vxlans rather than the raw bitsets. A pool that is not
+// configured is reported with no free ids.
+func (g *Oper) DumpJSON() ([]byte, error) {
+	allocMutex.RLock()
+	defer allocMutex.RUnlock()
+
+	dump := &operDump{
+		DefaultNetwork:  g.DefaultNetwork,
+		FreeVXLANsStart: g.FreeVXLANsStart,
+	}
+
+	gc := &Cfg{CommonState: g.CommonState}
+	vlanOper, err := gc.readVLANOper()
+	if err == nil {
+		dump.FreeVLANs = vlanOper.FreeVLANs.Count()
+	} else if core.ErrIfKeyExists(err) != nil {
+		return nil, err
+	}
+	vxlanOper, err := gc.readVXLANOper()
+	if err == nil {
+		dump.FreeVXLANs = vxlanOper.FreeVXLANs.Count()
+	} else if core.ErrIfKeyExists(err) != nil {
+		return nil, err
+	}
+
+	return json.Marshal(dump)
+}
+
+// Equal checks if the two configs hold the same settings, i.e. they would be
+// stored the same. The state driver and the runtime hooks are ignored.
+func (gc *Cfg) Equal(other *Cfg) bool {
+	if gc == nil || other == nil {
+		return gc == other
+	}
+
+	gcBytes, err := json.Marshal(gc)
+	if err != nil {
+		return false
+	}
+	otherBytes, err := json.Marshal(other)
+	if err != nil {
+		return false
+	}
+
+	return bytes.Equal(gcBytes, otherBytes)
+}
+
+// Hash returns a digest of the config's settings; configs that are Equal
+// have the same hash.
+func (gc *Cfg) Hash() string {
+	cfgBytes, err := json.Marshal(gc)
+	if err != nil {
+		return ""
+	}
+
+	return fmt.Sprintf("%x", sha256.Sum256(cfgBytes))
+}
+
+// Diff returns a human readable list of the auto-allocation parameters that
+// differ between gc and other, e.g. "Auto.VLANs: 1-100 -> 1-200".
+func (gc *Cfg) Diff(other *Cfg) []string {
+	diffs := []string{}
+	oldAuto := reflect.ValueOf(gc.Auto)
+	newAuto := reflect.ValueOf(other.Auto)
+	for i := 0; i < oldAuto.NumField(); i++ {
+		oldVal := oldAuto.Field(i).Interface()
+		newVal := newAuto.Field(i).Interface()
+		if !reflect.DeepEqual(oldVal, newVal) {
+			diffs = append(diffs, fmt.Sprintf("Auto.%s: %v -> %v",
+				oldAuto.Type().Field(i).Name, oldVal, newVal))
+		}
+	}
+
+	return diffs
+}
+
+// checkErrors checks the vlan or vxlan (per res) settings of the config. All
+// the problems found are returned together, joined into one error.
 func (gc *Cfg) checkErrors(res string) error {
-	var err error
+	errs := []error{}
 	if res == "vlan" {
-		_, err = netutils.ParseTagRanges(gc.Auto.VLANs, "vlan")
+		vlanRanges, err := gc.VLANRanges()
 		if err != nil {
-			return err
+			errs = append(errs, err)
+		}
+		// vlans 0 and 4095 are reserved and never allocated
+		for _, vlanRange := range vlanRanges {
+			if gc.Auto.VLANs != "" && (vlanRange.Min == 0 || vlanRange.Max >= 4095) {
+				errs = append(errs, core.Errorf("vlan range %d-%d includes reserved vlans 0 or 4095",
+					vlanRange.Min, vlanRange.Max))
+			}
+		}
+		for _, vlan := range gc.Auto.ReservedVLANs {
+			if vlan > 4095 {
+				errs = append(errs, core.Errorf("reserved vlan %d is out of range 0-4095", vlan))
+			}
+		}
+		if gc.Quota.MaxVLANs > maxVLANQuota {
+			errs = append(errs, core.Errorf("Quota.MaxVLANs %d exceeds the maximum of %d",
+				gc.Quota.MaxVLANs, maxVLANQuota))
 		}
 	} else if res == "vxlan" {
-		_, err = netutils.ParseTagRanges(gc.Auto.VXLANs, "vxlan")
-		if err != nil {
-			return err
+		if _, err := gc.VXLANRanges(); err != nil {
+			errs = append(errs, err)
+		}
+		if gc.Quota.MaxVXLANs > maxVXLANQuota {
+			errs = append(errs, core.Errorf("Quota.MaxVXLANs %d exceeds the maximum of %d",
+				gc.Quota.MaxVXLANs, maxVXLANQuota))
 		}
 	}
-	return err
+
+	return errors.Join(errs...)
+}
+
+// ValidateConfig checks the config for correctness without touching any
+// state, e.g. for validating a config file before it is applied. All the
+// problems found are returned together, joined into one error.
+func ValidateConfig(gc *Cfg) error {
+	errs := []error{}
+	for _, res := range []string{"vlan", "vxlan"} {
+		if err := gc.checkErrors(res); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
 }
 
 // Parse parses a JSON config into a *gstate.Cfg.
@@ -90,283 +631,2232 @@ func Parse(configBytes []byte) (*Cfg, error) {
 		return nil, err
 	}
 
-	err = gc.checkErrors("vlan")
+	err = ValidateConfig(&gc)
 	if err != nil {
 		return nil, err
 	}
 
-	err = gc.checkErrors("vxlan")
-	if err != nil {
+	return &gc, err
+}
+
+// ConfigBuilder builds a Cfg programmatically, starting from the default
+// vlan and vxlan ranges.
+type ConfigBuilder struct {
+	gc Cfg
+}
+
+// NewConfigBuilder returns a builder for a config with the default ranges.
+func NewConfigBuilder() *ConfigBuilder {
+	return &ConfigBuilder{gc: Cfg{Auto: AutoParams{VLANs: defaultVLANRange, VXLANs: defaultVXLANRange}}}
+}
+
+// WithVLANRange sets the vlans to allocate from, e.g. "1-100,200-300".
+func (b *ConfigBuilder) WithVLANRange(vlans string) *ConfigBuilder {
+	b.gc.Auto.VLANs = vlans
+	return b
+}
+
+// WithVXLANRange sets the vxlans to allocate from, e.g. "10000-20000".
+func (b *ConfigBuilder) WithVXLANRange(vxlans string) *ConfigBuilder {
+	b.gc.Auto.VXLANs = vxlans
+	return b
+}
+
+// WithQuota caps the number of vlans and vxlans allocated at a time.
+func (b *ConfigBuilder) WithQuota(maxVLANs, maxVXLANs uint) *ConfigBuilder {
+	b.gc.Quota = Quota{MaxVLANs: maxVLANs, MaxVXLANs: maxVXLANs}
+	return b
+}
+
+// WithStateDriver sets the state driver the config is stored with.
+func (b *ConfigBuilder) WithStateDriver(d core.StateDriver) *ConfigBuilder {
+	b.gc.StateDriver = d
+	return b
+}
+
+// Build validates the config and returns it. Each call returns a new Cfg.
+func (b *ConfigBuilder) Build() (*Cfg, error) {
+	gc := b.gc
+	if err := ValidateConfig(&gc); err != nil {
 		return nil, err
 	}
 
-	return &gc, err
+	return &gc, nil
 }
 
 // Write the state
 func (gc *Cfg) Write() error {
-	key := cfgGlobalPath
-	return gc.StateDriver.WriteState(key, gc, json.Marshal)
+	if gc.StateDriver == nil {
+		return ErrNilStateDriver
+	}
+	key := CfgKey()
+	return gc.StateDriver.WriteState(key, gc, serializerOrDefault(gc.Serializer).Marshal)
+}
+
+// WriteIfUnchanged writes the state only if the stored config still matches
+// previous, the config as last read by the caller; a nil previous expects no
+// stored config. Otherwise ErrConflict is returned and the caller should
+// re-read, reapply its change and retry.
+//
+// The state driver has no compare-and-swap, so the check is only atomic with
+// respect to other WriteIfUnchanged calls within this process.
+func (gc *Cfg) WriteIfUnchanged(previous *Cfg) error {
+	cfgWriteMutex.Lock()
+	defer cfgWriteMutex.Unlock()
+
+	stored := &Cfg{Serializer: gc.Serializer}
+	stored.StateDriver = gc.StateDriver
+	err := stored.Read("")
+	if err != nil {
+		if core.ErrIfKeyExists(err) != nil {
+			return err
+		}
+		stored = nil
+	}
+
+	if (stored == nil) != (previous == nil) {
+		return ErrConflict
+	}
+	if stored == nil {
+		return gc.Write()
+	}
+
+	if !stored.Equal(previous) {
+		return ErrConflict
+	}
+
+	return gc.Write()
 }
 
 // Read the state
 func (gc *Cfg) Read(dummy string) error {
-	key := cfgGlobalPath
-	return gc.StateDriver.ReadState(key, gc, json.Unmarshal)
+	if gc.StateDriver == nil {
+		return ErrNilStateDriver
+	}
+	key := CfgKey()
+	return gc.StateDriver.ReadState(key, gc, serializerOrDefault(gc.Serializer).Unmarshal)
 }
 
 // ReadAll global config state
 func (gc *Cfg) ReadAll() ([]core.State, error) {
-	return gc.StateDriver.ReadAllState(cfgGlobalPrefix, gc, json.Unmarshal)
+	if gc.StateDriver == nil {
+		return nil, ErrNilStateDriver
+	}
+	return gc.StateDriver.ReadAllState(cfgGlobalPrefix, gc,
+		serializerOrDefault(gc.Serializer).Unmarshal)
 }
 
 // Clear the state
 func (gc *Cfg) Clear() error {
-	key := cfgGlobalPath
+	if gc.StateDriver == nil {
+		return ErrNilStateDriver
+	}
+	key := CfgKey()
 	return gc.StateDriver.ClearState(key)
 }
 
+// runWithContext runs fn and waits for it to complete or for ctx to be done,
+// whichever happens first. The state driver calls can't be interrupted, so
+// fn may still complete in the background after ctx is done; callers pass
+// it a copy of the state to keep it from racing with the caller.
+func runWithContext(ctx context.Context, fn func() error) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- fn()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WriteContext writes the state, giving up when ctx is done.
+func (gc *Cfg) WriteContext(ctx context.Context) error {
+	tmp := *gc
+	return runWithContext(ctx, tmp.Write)
+}
+
+// ReadContext reads the state, giving up when ctx is done.
+func (gc *Cfg) ReadContext(ctx context.Context, id string) error {
+	tmp := *gc
+	err := runWithContext(ctx, func() error { return tmp.Read(id) })
+	if err != nil {
+		return err
+	}
+
+	*gc = tmp
+	return nil
+}
+
+// ClearContext clears the state, giving up when ctx is done.
+func (gc *Cfg) ClearContext(ctx context.Context) error {
+	tmp := *gc
+	return runWithContext(ctx, tmp.Clear)
+}
+
 // Write the state
 func (g *Oper) Write() error {
-	key := operGlobalPath
-	return g.StateDriver.WriteState(key, g, json.Marshal)
+	if g.StateDriver == nil {
+		return ErrNilStateDriver
+	}
+	key := OperKey()
+	return g.StateDriver.WriteState(key, g, serializerOrDefault(g.Serializer).Marshal)
 }
 
 // Read the state
 func (g *Oper) Read(dummy string) error {
-	key := operGlobalPath
-	return g.StateDriver.ReadState(key, g, json.Unmarshal)
+	if g.StateDriver == nil {
+		return ErrNilStateDriver
+	}
+	key := OperKey()
+	return g.StateDriver.ReadState(key, g, serializerOrDefault(g.Serializer).Unmarshal)
 }
 
 // ReadAll the global oper state
 func (g *Oper) ReadAll() ([]core.State, error) {
-	return g.StateDriver.ReadAllState(operGlobalPrefix, g, json.Unmarshal)
+	if g.StateDriver == nil {
+		return nil, ErrNilStateDriver
+	}
+	return g.StateDriver.ReadAllState(operGlobalPrefix, g,
+		serializerOrDefault(g.Serializer).Unmarshal)
 }
 
 // Clear the state.
 func (g *Oper) Clear() error {
-	key := operGlobalPath
+	if g.StateDriver == nil {
+		return ErrNilStateDriver
+	}
+	key := OperKey()
 	return g.StateDriver.ClearState(key)
 }
 
-func (gc *Cfg) initVXLANBitset(vxlans string) (*resources.AutoVXLANCfgResource, uint, error) {
+// WatchAll state transitions and send them through the channel.
+func (gc *Cfg) WatchAll(rsps chan core.WatchState) error {
+	if gc.StateDriver == nil {
+		return ErrNilStateDriver
+	}
+	return gc.StateDriver.WatchAllState(cfgGlobalPrefix, gc,
+		serializerOrDefault(gc.Serializer).Unmarshal, rsps)
+}
+
+// WatchGlobalCfg streams the global configuration each time it is written.
+// The returned channel is closed when the watch fails or ctx is done.
+// Deletions of the configuration are not reported. The state drivers provide
+// no way to stop a watch, so once ctx is done the updates are drained and
+// dropped, keeping the driver from blocking on them.
+func WatchGlobalCfg(ctx context.Context, d core.StateDriver) (<-chan *Cfg, error) {
+	if d == nil {
+		return nil, ErrNilStateDriver
+	}
+
+	gc := &Cfg{}
+	gc.StateDriver = d
+
+	rsps := make(chan core.WatchState)
+	recvErr := make(chan error, 1)
+	go func() {
+		recvErr <- gc.WatchAll(rsps)
+	}()
+
+	cfgs := make(chan *Cfg)
+	go func() {
+		defer close(cfgs)
+		for {
+			select {
+			case <-ctx.Done():
+				go drainWatch(rsps, recvErr)
+				return
+			case err := <-recvErr:
+				logger.Errorf("global config watch failed: %v", err)
+				return
+			case rsp := <-rsps:
+				cfg, ok := rsp.Curr.(*Cfg)
+				if !ok || cfg == nil {
+					continue
+				}
+				select {
+				case cfgs <- cfg:
+				case <-ctx.Done():
+					go drainWatch(rsps, recvErr)
+					return
+				}
+			}
+		}
+	}()
+
+	return cfgs, nil
+}
+
+// drainWatch discards the updates of a watch until it returns.
+func drainWatch(rsps chan core.WatchState, recvErr chan error) {
+	for {
+		select {
+		case <-rsps:
+		case <-recvErr:
+			return
+		}
+	}
+}
+
+// WriteContext writes the state, giving up when ctx is done.
+func (g *Oper) WriteContext(ctx context.Context) error {
+	tmp := *g
+	return runWithContext(ctx, tmp.Write)
+}
+
+// ReadContext reads the state, giving up when ctx is done.
+func (g *Oper) ReadContext(ctx context.Context, id string) error {
+	tmp := *g
+	err := runWithContext(ctx, func() error { return tmp.Read(id) })
+	if err != nil {
+		return err
+	}
+
+	*g = tmp
+	return nil
+}
+
+// ClearContext clears the state, giving up when ctx is done.
+func (g *Oper) ClearContext(ctx context.Context) error {
+	tmp := *g
+	return runWithContext(ctx, tmp.Clear)
+}
+
+// ReadAllOper reads all the global oper state.
+func ReadAllOper(d core.StateDriver) ([]*Oper, error) {
+	if d == nil {
+		return nil, ErrNilStateDriver
+	}
+
+	g := &Oper{}
+	g.StateDriver = d
+	values, err := g.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	opers := []*Oper{}
+	for _, value := range values {
+		opers = append(opers, value.(*Oper))
+	}
+
+	return opers, nil
+}
+
+// ReadAllGlobalCfgLenient reads all the global configs, skipping the ones
+// that can't be parsed instead of failing. The configs are decoded with s, or
+// as JSON if s is nil. The configs read are returned along with an error for
+// each entry that was skipped.
+func ReadAllGlobalCfgLenient(d core.StateDriver, s *Serializer) ([]*Cfg, []error) {
+	if d == nil {
+		return nil, []error{ErrNilStateDriver}
+	}
+
+	values, err := d.ReadAll(cfgGlobalPrefix)
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	cfgs := []*Cfg{}
+	errs := []error{}
+	for idx, value := range values {
+		gc := &Cfg{Serializer: s}
+		if err := serializerOrDefault(s).Unmarshal(value, gc); err != nil {
+			errs = append(errs, fmt.Errorf("global config entry %d: %w", idx, err))
+			continue
+		}
+		gc.StateDriver = d
+		cfgs = append(cfgs, gc)
+	}
+
+	return cfgs, errs
+}
+
+// PoolUsage is the number of free and used ids of a pool.
+type PoolUsage struct {
+	Free uint `json:"free"`
+	Used uint `json:"used"`
+}
+
+// Usage is the usage of the vlan, local vlan and vxlan pools of a resource.
+type Usage struct {
+	VLANs      PoolUsage `json:"vlans"`
+	LocalVLANs PoolUsage `json:"localVLANs"`
+	VXLANs     PoolUsage `json:"vxlans"`
+}
+
+// poolUsageOf returns the usage of a pool given its configured and free
+// ids; a missing free bitset means nothing was allocated yet.
+func poolUsageOf(cfg, free *bitset.BitSet) PoolUsage {
+	if free == nil {
+		return PoolUsage{Free: cfg.Count()}
+	}
+
+	return PoolUsage{Free: free.Count(), Used: cfg.DifferenceCardinality(free)}
+}
+
+// ResourceUsage returns the usage of every vlan and vxlan resource, keyed by
+// resource id. Resources without oper state yet are reported as unused.
+func ResourceUsage(d core.StateDriver) (map[string]*Usage, error) {
+	if d == nil {
+		return nil, ErrNilStateDriver
+	}
+
+	allocMutex.RLock()
+	defer allocMutex.RUnlock()
+
+	usage := map[string]*Usage{}
+	usageOf := func(id string) *Usage {
+		if usage[id] == nil {
+			usage[id] = &Usage{}
+		}
+		return usage[id]
+	}
+
+	vlanCfg := &resources.AutoVLANCfgResource{}
+	vlanCfg.StateDriver = d
+	vlanCfgs, err := vlanCfg.ReadAll()
+	if core.ErrIfKeyExists(err) != nil {
+		return nil, err
+	}
+	for _, state := range vlanCfgs {
+		cfg := state.(*resources.AutoVLANCfgResource)
+		oper := &resources.AutoVLANOperResource{}
+		oper.StateDriver = d
+		if err := oper.Read(cfg.ID); core.ErrIfKeyExists(err) != nil {
+			return nil, err
+		}
+		usageOf(cfg.ID).VLANs = poolUsageOf(cfg.VLANs, oper.FreeVLANs)
+	}
+
+	vxlanCfg := &resources.AutoVXLANCfgResource{}
+	vxlanCfg.StateDriver = d
+	vxlanCfgs, err := vxlanCfg.ReadAll()
+	if core.ErrIfKeyExists(err) != nil {
+		return nil, err
+	}
+	for _, state := range vxlanCfgs {
+		cfg := state.(*resources.AutoVXLANCfgResource)
+		oper := &resources.AutoVXLANOperResource{}
+		oper.StateDriver = d
+		if err := oper.Read(cfg.ID); core.ErrIfKeyExists(err) != nil {
+			return nil, err
+		}
+		usageOf(cfg.ID).LocalVLANs = poolUsageOf(cfg.LocalVLANs, oper.FreeLocalVLANs)
+		usageOf(cfg.ID).VXLANs = poolUsageOf(cfg.VXLANs, oper.FreeVXLANs)
+	}
+
+	return usage, nil
+}
+
+// Status is a report of the global config alongside the current usage of
+// its pools, e.g. for an operator status command.
+type Status struct {
+	VLANRanges     []netutils.TagRange `json:"vlanRanges,omitempty"`
+	VXLANRanges    []netutils.TagRange `json:"vxlanRanges,omitempty"`
+	Quota          Quota               `json:"quota"`
+	DefaultNetwork string              `json:"defaultNetwork,omitempty"`
+	Usage          Usage               `json:"usage"`
+}
+
+// GetStatus reads the global config and oper state and the usage of the
+// global vlan and vxlan pools into a single report.
+func GetStatus(d core.StateDriver) (*Status, error) {
+	gc := &Cfg{}
+	gc.StateDriver = d
+	if err := gc.Read(""); err != nil {
+		return nil, err
+	}
+	g := &Oper{}
+	g.StateDriver = d
+	if err := g.Read(""); core.ErrIfKeyExists(err) != nil {
+		return nil, err
+	}
+
+	status := &Status{Quota: gc.Quota, DefaultNetwork: g.DefaultNetwork}
+	if gc.Auto.VLANs != "" {
+		vlanRanges, err := gc.VLANRanges()
+		if err != nil {
+			return nil, err
+		}
+		status.VLANRanges = vlanRanges
+	}
+	if gc.Auto.VXLANs != "" {
+		vxlanRanges, err := gc.VXLANRanges()
+		if err != nil {
+			return nil, err
+		}
+		status.VXLANRanges = vxlanRanges
+	}
+
+	usage, err := ResourceUsage(d)
+	if err != nil {
+		return nil, err
+	}
+	if usage["global"] != nil {
+		status.Usage = *usage["global"]
+	}
+
+	return status, nil
+}
+
+// backupVersion is the version of the document produced by Export.
+const backupVersion = 1
+
+// backup is the portable form of the global state, including the vlan and
+// vxlan resources holding the allocations. Absent state is left out.
+type backup struct {
+	Version   int                              `json:"version"`
+	Cfg       *Cfg                             `json:"cfg,omitempty"`
+	Oper      *Oper                            `json:"oper,omitempty"`
+	VLANCfg   *resources.AutoVLANCfgResource   `json:"vlanCfg,omitempty"`
+	VLANOper  *resources.AutoVLANOperResource  `json:"vlanOper,omitempty"`
+	VXLANCfg  *resources.AutoVXLANCfgResource  `json:"vxlanCfg,omitempty"`
+	VXLANOper *resources.AutoVXLANOperResource `json:"vxlanOper,omitempty"`
+}
+
+// Export returns the global config and oper state, along with the vlan and
+// vxlan allocations, as a single versioned JSON document for Import.
+func Export(d core.StateDriver) ([]byte, error) {
+	if d == nil {
+		return nil, ErrNilStateDriver
+	}
+
+	allocMutex.RLock()
+	defer allocMutex.RUnlock()
+
+	b := &backup{Version: backupVersion}
+	gc := &Cfg{}
+	gc.StateDriver = d
+	g := &Oper{}
+	g.StateDriver = d
+
+	var err error
+	if err = gc.Read(""); err == nil {
+		b.Cfg = gc
+	} else if core.ErrIfKeyExists(err) != nil {
+		return nil, err
+	}
+	if err = g.Read(""); err == nil {
+		b.Oper = g
+	} else if core.ErrIfKeyExists(err) != nil {
+		return nil, err
+	}
+	if b.VLANCfg, err = gc.readVLANCfg(); core.ErrIfKeyExists(err) != nil {
+		return nil, err
+	}
+	if b.VLANOper, err = gc.readVLANOper(); core.ErrIfKeyExists(err) != nil {
+		return nil, err
+	}
+	if b.VXLANCfg, err = gc.readVXLANCfg(); core.ErrIfKeyExists(err) != nil {
+		return nil, err
+	}
+	if b.VXLANOper, err = gc.readVXLANOper(); core.ErrIfKeyExists(err) != nil {
+		return nil, err
+	}
+
+	return json.Marshal(b)
+}
+
+// Import writes the state exported by Export to d, overwriting any existing
+// global state, so importing the same document again is harmless.
+func Import(d core.StateDriver, data []byte) error {
+	if d == nil {
+		return ErrNilStateDriver
+	}
+
+	b := &backup{}
+	if err := json.Unmarshal(data, b); err != nil {
+		return err
+	}
+	if b.Version != backupVersion {
+		return core.Errorf("unsupported backup version %d, expecting %d", b.Version, backupVersion)
+	}
+
+	allocMutex.Lock()
+	defer unlockAlloc()
+
+	states := []core.State{}
+	if b.Cfg != nil {
+		b.Cfg.StateDriver = d
+		states = append(states, b.Cfg)
+	}
+	if b.Oper != nil {
+		b.Oper.StateDriver = d
+		states = append(states, b.Oper)
+	}
+	if b.VLANCfg != nil {
+		b.VLANCfg.StateDriver = d
+		states = append(states, b.VLANCfg)
+	}
+	if b.VLANOper != nil {
+		b.VLANOper.StateDriver = d
+		states = append(states, b.VLANOper)
+	}
+	if b.VXLANCfg != nil {
+		b.VXLANCfg.StateDriver = d
+		states = append(states, b.VXLANCfg)
+	}
+	if b.VXLANOper != nil {
+		b.VXLANOper.StateDriver = d
+		states = append(states, b.VXLANOper)
+	}
+
+	for _, state := range states {
+		if err := state.Write(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DeleteGlobalState clears both the global config and oper state. Both are
+// attempted even if one fails, and state that is already absent is not an
+// error, so a partially failed call can simply be retried.
+func DeleteGlobalState(d core.StateDriver) error {
+	if d == nil {
+		return ErrNilStateDriver
+	}
+
+	allocMutex.Lock()
+	defer unlockAlloc()
+
+	gc := &Cfg{}
+	gc.StateDriver = d
+	cfgErr := core.ErrIfKeyExists(gc.Clear())
+
+	g := &Oper{}
+	g.StateDriver = d
+	operErr := core.ErrIfKeyExists(g.Clear())
+
+	switch {
+	case cfgErr != nil && operErr != nil:
+		return core.Errorf("failed to clear global config state: %s, and oper state: %s",
+			cfgErr, operErr)
+	case cfgErr != nil:
+		return core.Errorf("failed to clear global config state (oper state cleared): %s",
+			cfgErr)
+	case operErr != nil:
+		return core.Errorf("failed to clear global oper state (config state cleared): %s",
+			operErr)
+	}
+
+	return nil
+}
+
+func (gc *Cfg) initVXLANBitset(vxlans string) (*resources.AutoVXLANCfgResource, uint, error) {
+
+	vxlanRanges, err := netutils.ParseTagRanges(vxlans, "vxlan")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// all the ranges are mapped into the bitset relative to the lowest vxlan
+	minVxlan, maxVxlan := vxlanRanges[0].Min, vxlanRanges[0].Max
+	for _, vxlanRange := range vxlanRanges {
+		if vxlanRange.Min < minVxlan {
+			minVxlan = vxlanRange.Min
+		}
+		if vxlanRange.Max > maxVxlan {
+			maxVxlan = vxlanRange.Max
+		}
+	}
+
+	// size the bitset to the configured span; bit 0 is never used
+	freeVXLANsStart := uint(minVxlan) - 1
+	vxlanRsrcCfg := &resources.AutoVXLANCfgResource{}
+	vxlanRsrcCfg.VXLANs = bitset.New(uint(maxVxlan) - freeVXLANsStart + 1)
+	for _, vxlanRange := range vxlanRanges {
+		for vxlan := vxlanRange.Min; vxlan <= vxlanRange.Max; vxlan++ {
+			vxlanRsrcCfg.VXLANs.Set(uint(vxlan) - freeVXLANsStart)
+		}
+	}
+
+	// Initialize local vlan bitset
+	vxlanRsrcCfg.LocalVLANs, err = gc.initVLANBitset(vxlanLocalVlanRange)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return vxlanRsrcCfg, freeVXLANsStart, nil
+}
+
+// GetVxlansInUse gets the vlans that are currently in use
+func (gc *Cfg) GetVxlansInUse() (uint, string) {
+	allocMutex.RLock()
+	defer allocMutex.RUnlock()
+
+	tempRm, err := resources.GetStateResourceManager()
+	if err != nil {
+		logger.Errorf("error getting resource manager: %s", err)
+		return 0, ""
+	}
+	ra := core.ResourceManager(tempRm)
+
+	return ra.GetResourceList("global", resources.AutoVXLANResource)
+}
+
+// AllocVXLAN allocates a new vxlan; ids for both the vxlan and vlan are returned.
+func (gc *Cfg) AllocVXLAN(reqVxlan uint) (vxlan uint, localVLAN uint, err error) {
+	allocMutex.Lock()
+	defer unlockAlloc()
+
+	return gc.allocVXLAN(reqVxlan, 0)
+}
+
+// AllocVXLANWithLocalVLAN allocates the next free vxlan mapped to the given
+// local vlan, e.g. to match a local vlan preconfigured in hardware. Nothing
+// is allocated if the local vlan is not available.
+func (gc *Cfg) AllocVXLANWithLocalVLAN(localVLAN uint) (vxlan uint, err error) {
+	if localVLAN < 1 || localVLAN > 4094 {
+		return 0, core.Errorf("local vlan %d is out of range 1-4094", localVLAN)
+	}
+
+	allocMutex.Lock()
+	defer unlockAlloc()
+
+	vxlan, _, err = gc.allocVXLAN(0, localVLAN)
+	return vxlan, err
+}
+
+// TryAllocVXLAN allocates the next free vxlan, reporting with ok whether one
+// was available instead of returning an error.
+func (gc *Cfg) TryAllocVXLAN() (vxlan uint, localVLAN uint, ok bool) {
+	allocMutex.Lock()
+	defer unlockAlloc()
+
+	oper, err := gc.readVXLANOper()
+	if err != nil || oper.FreeVXLANs.None() || oper.FreeLocalVLANs.None() {
+		return 0, 0, false
+	}
+
+	vxlan, localVLAN, err = gc.allocVXLAN(0, 0)
+	return vxlan, localVLAN, err == nil
+}
+
+// PeekVXLAN returns the vxlan and local vlan the next AllocVXLAN(0) would
+// return, without allocating them; ok is false if the allocation would fail.
+func (gc *Cfg) PeekVXLAN() (vxlan uint, localVLAN uint, ok bool) {
+	allocMutex.RLock()
+	defer allocMutex.RUnlock()
+
+	if gc.checkQuota("vxlan") != nil {
+		return 0, 0, false
+	}
+	g := gc.newOper()
+	if err := g.Read(""); err != nil {
+		return 0, 0, false
+	}
+	oper, err := gc.readVXLANOper()
+	if err != nil {
+		return 0, 0, false
+	}
+
+	vxlan, ok = oper.FreeVXLANs.NextSet(0)
+	if !ok {
+		return 0, 0, false
+	}
+	localVLAN, ok = oper.FreeLocalVLANs.NextSet(0)
+	if !ok {
+		return 0, 0, false
+	}
+
+	return vxlan + g.FreeVXLANsStart, localVLAN, true
+}
+
+// allocVXLAN allocates the requested vxlan and local vlan; a zero value for
+// either picks the next free one.
+func (gc *Cfg) allocVXLAN(reqVxlan, reqLocalVLAN uint) (vxlan uint, localVLAN uint, err error) {
+	if err := gc.checkQuota("vxlan"); err != nil {
+		return 0, 0, err
+	}
+
+	tempRm, err := resources.GetStateResourceManager()
+	if err != nil {
+		return 0, 0, err
+	}
+	ra := core.ResourceManager(tempRm)
+
+	g := gc.newOper()
+	err = g.Read("")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if reqVxlan != 0 && !g.inVXLANRange(reqVxlan) {
+		return 0, 0, fmt.Errorf("vxlan %d: %w: %w", reqVxlan, ErrVXLANUnavailable, ErrVXLANOutOfRange)
+	}
+
+	if (reqVxlan != 0) && (reqVxlan >= g.FreeVXLANsStart) {
+		reqVxlan = reqVxlan - g.FreeVXLANsStart
+	}
+
+	pair, err1 := ra.AllocateResourceVal("global", resources.AutoVXLANResource,
+		resources.VXLANVLANPair{VXLAN: reqVxlan, VLAN: reqLocalVLAN})
+	if err1 != nil {
+		return 0, 0, gc.exhaustedError("vxlan", err1)
+	}
+
+	vxlan = pair.(resources.VXLANVLANPair).VXLAN + g.FreeVXLANsStart
+	localVLAN = pair.(resources.VXLANVLANPair).VLAN
+
+	if g.VXLANLocalVLANs == nil {
+		g.VXLANLocalVLANs = map[uint]uint{}
+	}
+	g.VXLANLocalVLANs[vxlan] = localVLAN
+	if gc.TrackAllocationTime {
+		g.setAllocated("vxlan", vxlan, true)
+	}
+	if err = g.Write(); err != nil {
+		ra.DeallocateResourceVal("global", resources.AutoVXLANResource, pair)
+		return 0, 0, err
+	}
+
+	gc.notify(Event{Resource: "vxlan", Op: EventAlloc, Value: vxlan, LocalVLAN: localVLAN})
+	gc.checkThreshold("vxlan")
+
+	return
+}
+
+// readVXLANCfg reads the configuration of the global vxlan resource.
+func (gc *Cfg) readVXLANCfg() (*resources.AutoVXLANCfgResource, error) {
+	cfg := &resources.AutoVXLANCfgResource{}
+	cfg.StateDriver = gc.StateDriver
+	if err := cfg.Read("global"); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// readVXLANOper reads the operational state of the global vxlan resource.
+func (gc *Cfg) readVXLANOper() (*resources.AutoVXLANOperResource, error) {
+	oper := &resources.AutoVXLANOperResource{}
+	oper.StateDriver = gc.StateDriver
+	if err := oper.Read("global"); err != nil {
+		return nil, err
+	}
+
+	return oper, nil
+}
+
+// NumFreeVXLANs returns the number of vxlans available for allocation.
+func (gc *Cfg) NumFreeVXLANs() (uint, error) {
+	allocMutex.RLock()
+	defer allocMutex.RUnlock()
+
+	oper, err := gc.readVXLANOper()
+	if err != nil {
+		return 0, err
+	}
+
+	return oper.FreeVXLANs.Count(), nil
+}
+
+// NumTotalVXLANs returns the number of vxlans in the configured pool.
+func (gc *Cfg) NumTotalVXLANs() (uint, error) {
+	allocMutex.RLock()
+	defer allocMutex.RUnlock()
+
+	cfg, err := gc.readVXLANCfg()
+	if err != nil {
+		return 0, err
+	}
+
+	return cfg.VXLANs.Count(), nil
+}
+
+// SetVXLAN reserves a specific vxlan so that it is never handed out by
+// AllocVXLAN. Unlike AllocVXLAN, no local vlan is consumed for it. The
+// reservation is released with FreeVXLANByVNI, or FreeVXLAN with a zero
+// local vlan.
+func (gc *Cfg) SetVXLAN(vxlan uint) error {
+	allocMutex.Lock()
+	defer unlockAlloc()
+
+	vxlanRanges, err := gc.VXLANRanges()
+	if err != nil {
+		return err
+	}
+
+	if vxlan == 0 || !inTagRanges(vxlan, vxlanRanges) {
+		return fmt.Errorf("vxlan %d is outside the configured range %q: %w",
+			vxlan, gc.Auto.VXLANs, ErrVXLANOutOfRange)
+	}
+
+	g := gc.newOper()
+	err = g.Read("")
+	if err != nil {
+		return err
+	}
+
+	oper, err := gc.readVXLANOper()
+	if err != nil {
+		return err
+	}
+
+	if !oper.FreeVXLANs.Test(vxlan - g.FreeVXLANsStart) {
+		return fmt.Errorf("vxlan %d is already in use: %w", vxlan, ErrVXLANUnavailable)
+	}
+	oper.FreeVXLANs.Clear(vxlan - g.FreeVXLANsStart)
+	if err = oper.Write(); err != nil {
+		return err
+	}
+
+	if g.ReservedVXLANs == nil {
+		g.ReservedVXLANs = map[uint]bool{}
+	}
+	g.ReservedVXLANs[vxlan] = true
+	if err = g.Write(); err != nil {
+		oper.FreeVXLANs.Set(vxlan - g.FreeVXLANsStart)
+		oper.Write()
+		return err
+	}
+
+	return nil
+}
+
+// FreeVXLAN returns a VXLAN id to the pool.
+func (gc *Cfg) FreeVXLAN(vxlan uint, localVLAN uint) error {
+	allocMutex.Lock()
+	defer unlockAlloc()
+
+	return gc.freeVXLAN(vxlan, localVLAN)
+}
+
+func (gc *Cfg) freeVXLAN(vxlan uint, localVLAN uint) error {
+	tempRm, err := resources.GetStateResourceManager()
+	if err != nil {
+		return err
+	}
+	ra := core.ResourceManager(tempRm)
+
+	g := gc.newOper()
+	err = g.Read("")
+	if err != nil {
+		return core.ErrIfKeyExists(err)
+	}
+
+	if g.ReservedVXLANs[vxlan] {
+		if localVLAN != 0 {
+			return core.Errorf("vxlan %d is reserved without a local vlan, not mapped to %d",
+				vxlan, localVLAN)
+		}
+		return gc.releaseVXLAN(g, vxlan)
+	}
+
+	if localVLAN < 1 || localVLAN > 4094 {
+		return core.Errorf("local vlan %d is out of range 1-4094", localVLAN)
+	}
+
+	cfg, err := gc.readVXLANCfg()
+	if err != nil {
+		return err
+	}
+	if !g.inVXLANRange(vxlan) || !cfg.VXLANs.Test(vxlan-g.FreeVXLANsStart) {
+		return fmt.Errorf("vxlan %d: %w", vxlan, ErrVXLANOutOfRange)
+	}
+	oper, err := gc.readVXLANOper()
+	if err != nil {
+		return err
+	}
+	if oper.FreeVXLANs.Test(vxlan - g.FreeVXLANsStart) {
+		// already free; releasing the local vlan again could hand it out
+		// twice if it was since mapped to another vxlan
+		return nil
+	}
+	if recorded, ok := g.VXLANLocalVLANs[vxlan]; ok && recorded != localVLAN {
+		return core.Errorf("vxlan %d is mapped to local vlan %d, not %d",
+			vxlan, recorded, localVLAN)
+	}
+
+	err = ra.DeallocateResourceVal("global", resources.AutoVXLANResource,
+		resources.VXLANVLANPair{
+			VXLAN: vxlan - g.FreeVXLANsStart,
+			VLAN:  localVLAN})
+	if err != nil {
+		return err
+	}
+
+	_, mapped := g.VXLANLocalVLANs[vxlan]
+	_, tracked := g.AllocatedAt[allocationKey("vxlan", vxlan)]
+	if mapped || tracked {
+		delete(g.VXLANLocalVLANs, vxlan)
+		g.setAllocated("vxlan", vxlan, false)
+		if err = g.Write(); err != nil {
+			return err
+		}
+	}
+
+	gc.notify(Event{Resource: "vxlan", Op: EventFree, Value: vxlan, LocalVLAN: localVLAN})
+	return nil
+}
+
+// releaseVXLAN releases a vxlan reserved with SetVXLAN.
+func (gc *Cfg) releaseVXLAN(g *Oper, vxlan uint) error {
+	oper, err := gc.readVXLANOper()
+	if err != nil {
+		return err
+	}
+	oper.FreeVXLANs.Set(vxlan - g.FreeVXLANsStart)
+	if err = oper.Write(); err != nil {
+		return err
+	}
+
+	delete(g.ReservedVXLANs, vxlan)
+	return g.Write()
+}
+
+// FreeVXLANByVNI returns a VXLAN id to the pool along with the local vlan it
+// was allocated with, or releases it if it was reserved with SetVXLAN.
+func (gc *Cfg) FreeVXLANByVNI(vxlan uint) error {
+	allocMutex.Lock()
+	defer unlockAlloc()
+
+	g := gc.newOper()
+	if err := g.Read(""); err != nil {
+		return err
+	}
+
+	if g.ReservedVXLANs[vxlan] {
+		return gc.releaseVXLAN(g, vxlan)
+	}
+	localVLAN, ok := g.VXLANLocalVLANs[vxlan]
+	if !ok {
+		return core.Errorf("no local vlan recorded for vxlan %d", vxlan)
+	}
+
+	return gc.freeVXLAN(vxlan, localVLAN)
+}
+
+// AllocVXLANContiguous allocates a block of count consecutive vxlans, each
+// mapped to its own local vlan. The first vxlan of the block and the local
+// vlans, in vxlan order, are returned. Nothing is allocated on failure.
+func (gc *Cfg) AllocVXLANContiguous(count uint) (startVxlan uint, localVLANs []uint, err error) {
+	allocMutex.Lock()
+	defer unlockAlloc()
+
+	if count == 0 {
+		return 0, nil, core.Errorf("invalid vxlan block size 0")
+	}
+
+	g := gc.newOper()
+	if err = g.Read(""); err != nil {
+		return 0, nil, err
+	}
+
+	oper, err := gc.readVXLANOper()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// find the first run of count free vxlans
+	start, found := oper.FreeVXLANs.NextSet(0)
+	for found {
+		end := start
+		for end-start+1 < count && oper.FreeVXLANs.Test(end+1) {
+			end++
+		}
+		if end-start+1 == count {
+			break
+		}
+		start, found = oper.FreeVXLANs.NextSet(end + 1)
+	}
+	if !found {
+		return 0, nil, fmt.Errorf("no block of %d contiguous vxlans available: %w",
+			count, ErrVXLANExhausted)
+	}
+
+	startVxlan = start + g.FreeVXLANsStart
+	localVLANs = []uint{}
+	for vxlan := startVxlan; vxlan < startVxlan+count; vxlan++ {
+		_, localVLAN, err := gc.allocVXLAN(vxlan, 0)
+		if err != nil {
+			for idx, localVLAN := range localVLANs {
+				if err := gc.freeVXLAN(startVxlan+uint(idx), localVLAN); err != nil {
+					logger.Errorf("error freeing vxlan %d: %s", startVxlan+uint(idx), err)
+				}
+			}
+			return 0, nil, err
+		}
+		localVLANs = append(localVLANs, localVLAN)
+	}
+
+	return startVxlan, localVLANs, nil
+}
+
+func clearReservedVLANs(vlanBitset *bitset.BitSet, reserved []uint) {
+	vlanBitset.Clear(0)
+	vlanBitset.Clear(4095)
+	for _, vlan := range reserved {
+		vlanBitset.Clear(vlan)
+	}
+}
+
+func (gc *Cfg) initVLANBitset(vlans string) (*bitset.BitSet, error) {
+
+	vlanBitset := netutils.CreateBitset(12)
+
+	vlanRanges, err := netutils.ParseTagRanges(vlans, "vlan")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, vlanRange := range vlanRanges {
+		for vlan := vlanRange.Min; vlan <= vlanRange.Max; vlan++ {
+			vlanBitset.Set(uint(vlan))
+		}
+	}
+	clearReservedVLANs(vlanBitset, gc.Auto.ReservedVLANs)
+
+	return vlanBitset, nil
+}
+
+// GetVlansInUse gets the vlans that are currently in use
+func (gc *Cfg) GetVlansInUse() (uint, string) {
+	allocMutex.RLock()
+	defer allocMutex.RUnlock()
+
+	tempRm, err := resources.GetStateResourceManager()
+	if err != nil {
+		logger.Errorf("error getting resource manager: %s", err)
+		return 0, ""
+	}
+	ra := core.ResourceManager(tempRm)
+
+	return ra.GetResourceList("global", resources.AutoVLANResource)
+}
+
+// AllocVLAN allocates a new VLAN resource. Returns an ID.
+func (gc *Cfg) AllocVLAN(reqVlan uint) (uint, error) {
+	allocMutex.Lock()
+	defer unlockAlloc()
+
+	return gc.allocVLAN(reqVlan)
+}
+
+// TryAllocVLAN allocates the next free vlan, reporting with ok whether one
+// was available instead of returning an error.
+func (gc *Cfg) TryAllocVLAN() (vlan uint, ok bool) {
+	allocMutex.Lock()
+	defer unlockAlloc()
+
+	oper, err := gc.readVLANOper()
+	if err != nil || oper.FreeVLANs.None() {
+		return 0, false
+	}
+
+	vlan, err = gc.allocVLAN(0)
+	return vlan, err == nil
+}
+
+// PeekVLAN returns the vlan the next AllocVLAN(0) would return, without
+// allocating it; ok is false if the allocation would fail.
+func (gc *Cfg) PeekVLAN() (vlan uint, ok bool) {
+	allocMutex.RLock()
+	defer allocMutex.RUnlock()
+
+	if gc.checkQuota("vlan") != nil {
+		return 0, false
+	}
+	oper, err := gc.readVLANOper()
+	if err != nil {
+		return 0, false
+	}
+
+	return oper.FreeVLANs.NextSet(0)
+}
+
+func (gc *Cfg) allocVLAN(reqVlan uint) (uint, error) {
+	if reqVlan > 4094 {
+		return 0, fmt.Errorf("vlan %d is out of range 1-4094: %w", reqVlan, ErrVLANUnavailable)
+	}
+	if err := gc.checkQuota("vlan"); err != nil {
+		return 0, err
+	}
+
+	tempRm, err := resources.GetStateResourceManager()
+	if err != nil {
+		return 0, err
+	}
+	ra := core.ResourceManager(tempRm)
+
+	vlan, err := ra.AllocateResourceVal("global", resources.AutoVLANResource, reqVlan)
+	if err != nil {
+		err = gc.exhaustedError("vlan", err)
+		logger.Errorf("alloc vlan failed: %q", err)
+		return 0, err
+	}
+	if gc.TrackAllocationTime {
+		if err = gc.trackAllocation("vlan", vlan.(uint), true); err != nil {
+			ra.DeallocateResourceVal("global", resources.AutoVLANResource, vlan)
+			return 0, err
+		}
+	}
+	// a lease left behind by a previous owner must not expire this vlan
+	if err = gc.setVLANLease(vlan.(uint), 0); err != nil {
+		ra.DeallocateResourceVal("global", resources.AutoVLANResource, vlan)
+		return 0, err
+	}
+	gc.notify(Event{Resource: "vlan", Op: EventAlloc, Value: vlan.(uint)})
+	gc.checkThreshold("vlan")
+
+	return vlan.(uint), err
+}
+
+// allocationKey returns the AllocatedAt key of a vlan or vxlan.
+func allocationKey(res string, id uint) string {
+	return fmt.Sprintf("%s/%d", res, id)
+}
+
+// setAllocated records the allocation time of a vlan or vxlan, or removes it
+// when the resource is freed.
+func (g *Oper) setAllocated(res string, id uint, allocated bool) {
+	if !allocated {
+		delete(g.AllocatedAt, allocationKey(res, id))
+		return
+	}
+
+	if g.AllocatedAt == nil {
+		g.AllocatedAt = map[string]time.Time{}
+	}
+	g.AllocatedAt[allocationKey(res, id)] = timeNow()
+}
+
+// trackAllocation updates the allocation time of a vlan or vxlan in the
+// stored oper state.
+func (gc *Cfg) trackAllocation(res string, id uint, allocated bool) error {
+	g := gc.newOper()
+	if err := g.Read(""); core.ErrIfKeyExists(err) != nil {
+		return err
+	}
+
+	g.setAllocated(res, id, allocated)
+	return g.Write()
+}
+
+// OldestAllocation returns the vlan or vxlan (per res) that has been
+// allocated the longest and for how long. The id is empty if no allocation
+// times were recorded.
+func (g *Oper) OldestAllocation(res string) (id string, age time.Duration) {
+	var oldest time.Time
+	prefix := res + "/"
+	for key, allocatedAt := range g.AllocatedAt {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if id == "" || allocatedAt.Before(oldest) {
+			id, oldest = strings.TrimPrefix(key, prefix), allocatedAt
+		}
+	}
+	if id == "" {
+		return "", 0
+	}
+
+	return id, timeNow().Sub(oldest)
+}
+
+// notify logs the event and queues it for the observer, if any.
+func (gc *Cfg) notify(ev Event) {
+	if ev.Resource == "vxlan" {
+		logger.Debugf("%s vxlan %d local vlan %d", ev.Op, ev.Value, ev.LocalVLAN)
+	} else {
+		logger.Debugf("%s %s %d", ev.Op, ev.Resource, ev.Value)
+	}
+
+	if gc.Observer != nil {
+		observer := gc.Observer
+		pendingCallbacks = append(pendingCallbacks, func() { observer.Notify(ev) })
+	}
+}
+
+// newOper returns the global oper state object, stored with the config's
+// state driver and serializer.
+func (gc *Cfg) newOper() *Oper {
+	g := &Oper{Serializer: gc.Serializer}
+	g.StateDriver = gc.StateDriver
+	return g
+}
+
+// poolUsage returns the number of free and used vlans or vxlans of the
+// configured pool; free bits outside the pool are not counted.
+func (gc *Cfg) poolUsage(res string) (free uint, used uint, err error) {
+	if res == "vlan" {
+		cfg, err := gc.readVLANCfg()
+		if err != nil {
+			return 0, 0, err
+		}
+		oper, err := gc.readVLANOper()
+		if err != nil {
+			return 0, 0, err
+		}
+		return cfg.VLANs.IntersectionCardinality(oper.FreeVLANs),
+			cfg.VLANs.DifferenceCardinality(oper.FreeVLANs), nil
+	}
+
+	cfg, err := gc.readVXLANCfg()
+	if err != nil {
+		return 0, 0, err
+	}
+	oper, err := gc.readVXLANOper()
+	if err != nil {
+		return 0, 0, err
+	}
+	return cfg.VXLANs.IntersectionCardinality(oper.FreeVXLANs),
+		cfg.VXLANs.DifferenceCardinality(oper.FreeVXLANs), nil
+}
+
+// exhaustedError adds the resource id and the number of free vlans or vxlans
+// (per res) to an exhaustion error; the count is non-zero when only the local
+// vlans ran out. Other errors are returned as is.
+func (gc *Cfg) exhaustedError(res string, err error) error {
+	if !errors.Is(err, ErrVLANExhausted) && !errors.Is(err, ErrVXLANExhausted) &&
+		!errors.Is(err, ErrLocalVLANExhausted) {
+		return err
+	}
+
+	free, _, usageErr := gc.poolUsage(res)
+	if usageErr != nil {
+		return err
+	}
+
+	return fmt.Errorf("%s pool %q has %d free: %w", res, "global", free, err)
+}
+
+// checkQuota returns ErrQuotaExceeded if the vlan or vxlan quota is already
+// used up. The in-use count is derived from the persisted pool state, so it
+// survives restarts.
+func (gc *Cfg) checkQuota(res string) error {
+	max := gc.Quota.MaxVLANs
+	if res == "vxlan" {
+		max = gc.Quota.MaxVXLANs
+	}
+	if max == 0 {
+		return nil
+	}
+
+	_, used, err := gc.poolUsage(res)
+	if err != nil {
+		return err
+	}
+	if used >= max {
+		return fmt.Errorf("%s quota of %d reached: %w", res, max, ErrQuotaExceeded)
+	}
+
+	return nil
+}
+
+// checkThreshold invokes the OnThreshold hook if the free percentage of the
+// vlan or vxlan pool dropped below the threshold.
+func (gc *Cfg) checkThreshold(res string) {
+	if gc.OnThreshold == nil {
+		return
+	}
+
+	free, used, err := gc.poolUsage(res)
+	if err != nil {
+		logger.Errorf("error getting %s pool usage: %s", res, err)
+		return
+	}
+	total := free + used
+	if total == 0 {
+		return
+	}
+
+	threshold := gc.ThresholdPct
+	if threshold == 0 {
+		threshold = defaultThresholdPct
+	}
+	pct := float64(free) * 100 / float64(total)
+	if pct < threshold {
+		onThreshold := gc.OnThreshold
+		pendingCallbacks = append(pendingCallbacks, func() { onThreshold(res, pct) })
+	}
+}
+
+// readVLANCfg reads the configuration of the global vlan resource.
+func (gc *Cfg) readVLANCfg() (*resources.AutoVLANCfgResource, error) {
+	cfg := &resources.AutoVLANCfgResource{}
+	cfg.StateDriver = gc.StateDriver
+	if err := cfg.Read("global"); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// readVLANOper reads the operational state of the global vlan resource.
+func (gc *Cfg) readVLANOper() (*resources.AutoVLANOperResource, error) {
+	oper := &resources.AutoVLANOperResource{}
+	oper.StateDriver = gc.StateDriver
+	if err := oper.Read("global"); err != nil {
+		return nil, err
+	}
+
+	return oper, nil
+}
+
+// NumFreeVLANs returns the number of vlans available for allocation.
+func (gc *Cfg) NumFreeVLANs() (uint, error) {
+	allocMutex.RLock()
+	defer allocMutex.RUnlock()
+
+	oper, err := gc.readVLANOper()
+	if err != nil {
+		return 0, err
+	}
+
+	return oper.FreeVLANs.Count(), nil
+}
+
+// NumTotalVLANs returns the number of vlans in the configured pool.
+func (gc *Cfg) NumTotalVLANs() (uint, error) {
+	allocMutex.RLock()
+	defer allocMutex.RUnlock()
+
+	cfg, err := gc.readVLANCfg()
+	if err != nil {
+		return 0, err
+	}
+
+	return cfg.VLANs.Count(), nil
+}
+
+// AllocVLANInRange allocates the lowest free VLAN within [min, max]. The
+// range must be a subset of 1-4094.
+func (gc *Cfg) AllocVLANInRange(min, max uint) (uint, error) {
+	allocMutex.Lock()
+	defer unlockAlloc()
+
+	if min > max {
+		return 0, core.Errorf("invalid vlan range %d-%d, min is greater than max", min, max)
+	}
+	if min < 1 || max > 4094 {
+		return 0, core.Errorf("invalid vlan range %d-%d, must be within 1-4094", min, max)
+	}
+
+	oper, err := gc.readVLANOper()
+	if err != nil {
+		return 0, err
+	}
+
+	vlan, ok := oper.FreeVLANs.NextSet(min)
+	if !ok || vlan > max {
+		return 0, fmt.Errorf("no vlans available in range %d-%d: %w", min, max, ErrVLANExhausted)
+	}
+
+	return gc.allocVLAN(vlan)
+}
+
+// Txn groups the vlans and vxlans allocated for one logical operation, so
+// they can all be released if a later step of the operation fails. Each
+// allocation is persisted as it is made; Rollback undoes them.
+type Txn struct {
+	gc     *Cfg
+	vlans  []uint
+	vxlans []VXLANLocalVLAN
+}
+
+// Begin starts a transaction for allocating from this config.
+func (gc *Cfg) Begin() *Txn {
+	return &Txn{gc: gc}
+}
+
+// AllocVLAN allocates a vlan as part of the transaction.
+func (txn *Txn) AllocVLAN(reqVlan uint) (uint, error) {
+	vlan, err := txn.gc.AllocVLAN(reqVlan)
+	if err != nil {
+		return 0, err
+	}
+
+	txn.vlans = append(txn.vlans, vlan)
+	return vlan, nil
+}
+
+// AllocVXLAN allocates a vxlan and its local vlan as part of the transaction.
+func (txn *Txn) AllocVXLAN(reqVxlan uint) (vxlan uint, localVLAN uint, err error) {
+	vxlan, localVLAN, err = txn.gc.AllocVXLAN(reqVxlan)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	txn.vxlans = append(txn.vxlans, VXLANLocalVLAN{VXLAN: vxlan, LocalVLAN: localVLAN})
+	return vxlan, localVLAN, nil
+}
+
+// Commit keeps the allocations made in the transaction.
+func (txn *Txn) Commit() {
+	txn.vlans = nil
+	txn.vxlans = nil
+}
+
+// Rollback releases all the allocations made in the transaction. It is a
+// no-op after Commit.
+func (txn *Txn) Rollback() error {
+	err := errors.Join(txn.gc.FreeVXLANs(txn.vxlans), txn.gc.FreeVLANs(txn.vlans))
+	txn.Commit()
+
+	return err
+}
+
+// AllocNetworkTag allocates the packet tag of a network for the given encap:
+// a vlan for "vlan", or a vxlan and its local vlan for "vxlan". Nothing is
+// allocated for an empty encap.
+func (gc *Cfg) AllocNetworkTag(encap string, reqTag uint) (tag uint, localVLAN uint, isVXLAN bool, err error) {
+	switch encap {
+	case "":
+		return 0, 0, false, nil
+	case "vlan":
+		tag, err = gc.AllocVLAN(reqTag)
+		return tag, 0, false, err
+	case "vxlan":
+		tag, localVLAN, err = gc.AllocVXLAN(reqTag)
+		return tag, localVLAN, true, err
+	}
+
+	return 0, 0, false, core.Errorf("invalid encap %q", encap)
+}
+
+// AllocVLANExcluding allocates the lowest free vlan that is not in exclude.
+func (gc *Cfg) AllocVLANExcluding(exclude []uint) (uint, error) {
+	allocMutex.Lock()
+	defer unlockAlloc()
+
+	oper, err := gc.readVLANOper()
+	if err != nil {
+		return 0, err
+	}
+
+	candidates := oper.FreeVLANs.Clone()
+	for _, vlan := range exclude {
+		candidates.Clear(vlan)
+	}
+
+	vlan, ok := candidates.NextSet(0)
+	if !ok {
+		return 0, fmt.Errorf("all free vlans are excluded: %w", ErrVLANExhausted)
+	}
+
+	return gc.allocVLAN(vlan)
+}
+
+// AllocVLANSpread allocates a free vlan spread out from the ones allocated
+// before, instead of the lowest one. The vlan ids are visited in 12-bit
+// bit-reversed order (0, 2048, 1024, 3072, 512, 2560, ...), which keeps
+// halving the gaps between the visited ids, and the first free one is
+// allocated. The order is fixed, so the result only depends on the free
+// vlans.
+func (gc *Cfg) AllocVLANSpread() (uint, error) {
+	allocMutex.Lock()
+	defer unlockAlloc()
+
+	oper, err := gc.readVLANOper()
+	if err != nil {
+		return 0, err
+	}
+
+	for i := uint(0); i < 4096; i++ {
+		vlan := uint(bits.Reverse16(uint16(i)) >> 4)
+		if oper.FreeVLANs.Test(vlan) {
+			return gc.allocVLAN(vlan)
+		}
+	}
+
+	return 0, gc.exhaustedError("vlan", ErrVLANExhausted)
+}
+
+// AllocVLANHighest allocates the highest free vlan, e.g. to hand out
+// infrastructure vlans from the top of the range.
+func (gc *Cfg) AllocVLANHighest() (uint, error) {
+	allocMutex.Lock()
+	defer unlockAlloc()
+
+	oper, err := gc.readVLANOper()
+	if err != nil {
+		return 0, err
+	}
+
+	vlan, ok := netutils.PrevSet(oper.FreeVLANs, 4094)
+	if !ok {
+		return 0, gc.exhaustedError("vlan", ErrVLANExhausted)
+	}
+
+	return gc.allocVLAN(vlan)
+}
+
+// FreeVLAN releases a VLAN for a given ID.
+func (gc *Cfg) FreeVLAN(vlan uint) error {
+	allocMutex.Lock()
+	defer unlockAlloc()
+
+	return gc.freeVLAN(vlan)
+}
+
+func (gc *Cfg) freeVLAN(vlan uint) error {
+	if vlan < 1 || vlan > 4094 {
+		return core.Errorf("vlan %d is out of range 1-4094", vlan)
+	}
+
+	cfg, err := gc.readVLANCfg()
+	if err != nil {
+		return err
+	}
+	if !cfg.VLANs.Test(vlan) {
+		return core.Errorf("vlan %d is not in the vlan pool", vlan)
+	}
+	oper, err := gc.readVLANOper()
+	if err != nil {
+		return err
+	}
+	if oper.FreeVLANs.Test(vlan) {
+		// already free; nothing to release or report
+		return nil
+	}
+
+	tempRm, err := resources.GetStateResourceManager()
+	if err != nil {
+		return err
+	}
+	ra := core.ResourceManager(tempRm)
+
+	err = ra.DeallocateResourceVal("global", resources.AutoVLANResource, vlan)
+	if err != nil {
+		return err
+	}
+	if gc.TrackAllocationTime {
+		if err = gc.trackAllocation("vlan", vlan, false); err != nil {
+			return err
+		}
+	}
+	if err = gc.setVLANLease(vlan, 0); err != nil {
+		return err
+	}
+
+	gc.notify(Event{Resource: "vlan", Op: EventFree, Value: vlan})
+	return nil
+}
+
+// AllocVLANWithTTL allocates the next free vlan with a lease of ttl; the vlan
+// is freed by ReapExpired once the lease has elapsed, unless it was freed
+// before. Vlans allocated otherwise never expire.
+func (gc *Cfg) AllocVLANWithTTL(ttl time.Duration) (vlan uint, err error) {
+	if ttl <= 0 {
+		return 0, core.Errorf("invalid vlan lease %v", ttl)
+	}
+
+	allocMutex.Lock()
+	defer unlockAlloc()
+
+	vlan, err = gc.allocVLAN(0)
+	if err != nil {
+		return 0, err
+	}
+	if err = gc.setVLANLease(vlan, ttl); err != nil {
+		gc.freeVLAN(vlan)
+		return 0, err
+	}
+
+	return vlan, nil
+}
+
+// setVLANLease records a lease of ttl on the vlan in the stored oper state,
+// or drops the vlan's lease if ttl is zero. The oper state is only written
+// by Process("vxlan"), so it may not exist yet for a vlan-only config.
+func (gc *Cfg) setVLANLease(vlan uint, ttl time.Duration) error {
+	g := gc.newOper()
+	if err := g.Read(""); core.ErrIfKeyExists(err) != nil {
+		return err
+	}
+
+	if ttl == 0 {
+		if _, ok := g.VLANLeases[vlan]; !ok {
+			return nil
+		}
+		delete(g.VLANLeases, vlan)
+		return g.Write()
+	}
+
+	if g.VLANLeases == nil {
+		g.VLANLeases = map[uint]time.Time{}
+	}
+	g.VLANLeases[vlan] = timeNow().Add(ttl)
+	return g.Write()
+}
+
+// ReapExpired frees the vlans whose lease has elapsed and returns them. It is
+// meant to be called periodically; as leases are kept in the oper state,
+// they survive restarts.
+func (gc *Cfg) ReapExpired() ([]uint, error) {
+	allocMutex.Lock()
+	defer unlockAlloc()
+
+	g := gc.newOper()
+	if err := g.Read(""); core.ErrIfKeyExists(err) != nil {
+		return nil, err
+	}
+
+	now := timeNow()
+	reaped := []uint{}
+	for vlan, expiry := range g.VLANLeases {
+		if expiry.After(now) {
+			continue
+		}
+		if err := gc.freeVLAN(vlan); err != nil {
+			return reaped, err
+		}
+		reaped = append(reaped, vlan)
+	}
+	sort.Slice(reaped, func(i, j int) bool { return reaped[i] < reaped[j] })
+
+	return reaped, nil
+}
+
+// FreeVLANs releases all the given vlans. Vlans that are already free are
+// ignored; the errors for the vlans that could not be freed are joined.
+func (gc *Cfg) FreeVLANs(vlans []uint) error {
+	allocMutex.Lock()
+	defer unlockAlloc()
+
+	var errs []error
+	for _, vlan := range vlans {
+		if err := gc.freeVLAN(vlan); err != nil {
+			errs = append(errs, fmt.Errorf("vlan %d: %w", vlan, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// SetVLANs claims the given vlans, e.g. the vlans already in use when
+// adopting existing networks. Vlans that are already allocated are skipped;
+// the errors for the vlans that could not be claimed, e.g. because they are
+// outside the configured ranges, are joined.
+func (gc *Cfg) SetVLANs(vlans []uint) error {
+	allocMutex.Lock()
+	defer unlockAlloc()
+
+	cfg, err := gc.readVLANCfg()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, vlan := range vlans {
+		if vlan == 0 {
+			errs = append(errs, core.Errorf("vlan 0 is reserved"))
+			continue
+		}
+		_, err := gc.allocVLAN(vlan)
+		if errors.Is(err, ErrVLANUnavailable) && cfg.VLANs.Test(vlan) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("vlan %d: %w", vlan, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// FreeVXLANs releases all the given vxlans along with their local vlans.
+// Vxlans that are already free are ignored; the errors for the vxlans that
+// could not be freed are joined.
+func (gc *Cfg) FreeVXLANs(pairs []VXLANLocalVLAN) error {
+	allocMutex.Lock()
+	defer unlockAlloc()
+
+	var errs []error
+	for _, pair := range pairs {
+		if err := gc.freeVXLAN(pair.VXLAN, pair.LocalVLAN); err != nil {
+			errs = append(errs, fmt.Errorf("vxlan %d: %w", pair.VXLAN, err))
+		}
+	}
 
-	vxlanRsrcCfg := &resources.AutoVXLANCfgResource{}
-	vxlanRsrcCfg.VXLANs = netutils.CreateBitset(14)
+	return errors.Join(errs...)
+}
 
-	vxlanRange := netutils.TagRange{}
-	vxlanRanges, err := netutils.ParseTagRanges(vxlans, "vxlan")
-	if err != nil {
-		return nil, 0, err
+// Capacities returns the number of vlans and vxlans this config yields,
+// using the same validation and bitset setup as Process, without touching
+// any state.
+func (gc *Cfg) Capacities() (vlans uint, vxlans uint, err error) {
+	if err = ValidateConfig(gc); err != nil {
+		return 0, 0, err
 	}
-	// XXX: REVISIT, we seem to accept one contiguous vxlan range
-	vxlanRange = vxlanRanges[0]
 
-	freeVXLANsStart := uint(vxlanRange.Min) - 1
-	for vxlan := vxlanRange.Min; vxlan <= vxlanRange.Max; vxlan++ {
-		vxlanRsrcCfg.VXLANs.Set(uint(vxlan) - freeVXLANsStart)
+	if gc.Auto.VLANs != "" {
+		vlanBitset, err := gc.initVLANBitset(gc.Auto.VLANs)
+		if err != nil {
+			return 0, 0, err
+		}
+		vlans = vlanBitset.Count()
 	}
 
-	// Initialize local vlan bitset
-	vxlanRsrcCfg.LocalVLANs, err = gc.initVLANBitset(vxlanLocalVlanRange)
-	if err != nil {
-		return nil, 0, err
+	if gc.Auto.VXLANs != "" {
+		vxlanRsrcCfg, _, err := gc.initVXLANBitset(gc.Auto.VXLANs)
+		if err != nil {
+			return 0, 0, err
+		}
+		vxlans = vxlanRsrcCfg.VXLANs.Count()
 	}
 
-	return vxlanRsrcCfg, freeVXLANsStart, nil
+	return vlans, vxlans, nil
 }
 
-// GetVxlansInUse gets the vlans that are currently in use
-func (gc *Cfg) GetVxlansInUse() (uint, string) {
-	tempRm, err := resources.GetStateResourceManager()
-	if err != nil {
-		log.Errorf("error getting resource manager: %s", err)
-		return 0, ""
-	}
-	ra := core.ResourceManager(tempRm)
+// Process validates, implements, and writes the state.
+func (gc *Cfg) Process(res string) error {
+	allocMutex.Lock()
+	defer unlockAlloc()
 
-	return ra.GetResourceList("global", resources.AutoVXLANResource)
+	return gc.process(res)
 }
 
-// AllocVXLAN allocates a new vxlan; ids for both the vxlan and vlan are returned.
-func (gc *Cfg) AllocVXLAN(reqVxlan uint) (vxlan uint, localVLAN uint, err error) {
+func (gc *Cfg) process(res string) error {
+	var err error
+
+	if gc.StateDriver == nil {
+		return ErrNilStateDriver
+	}
 
 	tempRm, err := resources.GetStateResourceManager()
 	if err != nil {
-		return 0, 0, err
+		return err
 	}
+
 	ra := core.ResourceManager(tempRm)
 
-	g := &Oper{}
-	g.StateDriver = gc.StateDriver
-	err = g.Read("")
+	err = gc.checkErrors(res)
 	if err != nil {
-		return 0, 0, err
+		return core.Errorf("process failed on error checks %s", err)
 	}
 
-	if reqVxlan != 0 && reqVxlan <= g.FreeVXLANsStart {
-		return 0, 0, errors.New("Requested vxlan is out of range")
+	// Only define a vlan resource if a valid range was specified
+	if res == "vlan" {
+		// the leases and allocation times belong to the vlan pool that is
+		// being recreated
+		g := gc.newOper()
+		err = g.Read("")
+		if core.ErrIfKeyExists(err) != nil {
+			return err
+		}
+		if err == nil {
+			g.VLANLeases = nil
+			for key := range g.AllocatedAt {
+				if strings.HasPrefix(key, "vlan/") {
+					delete(g.AllocatedAt, key)
+				}
+			}
+			err = g.Write()
+			if err != nil {
+				logger.Errorf("error '%s' updating global oper state %v \n", err, g)
+				return err
+			}
+		}
+		if gc.Auto.VLANs != "" {
+			var vlanRsrcCfg *bitset.BitSet
+			vlanRsrcCfg, err = gc.initVLANBitset(gc.Auto.VLANs)
+			if err != nil {
+				return err
+			}
+			err = ra.DefineResource("global", resources.AutoVLANResource, vlanRsrcCfg)
+			if err != nil {
+				return err
+			}
+		}
 	}
+	// Only define a vxlan resource if a valid range was specified
+	if res == "vxlan" {
+		// keep the oper state not owned by the vxlan resource, e.g. the
+		// default network and the vlan leases
+		g := gc.newOper()
+		err = g.Read("")
+		if core.ErrIfKeyExists(err) != nil {
+			return err
+		}
+		g.FreeVXLANsStart, g.VXLANRangeMin, g.VXLANRangeMax = 0, 0, 0
+		g.VXLANLocalVLANs = nil
+		g.ReservedVXLANs = nil
+		for key := range g.AllocatedAt {
+			if strings.HasPrefix(key, "vxlan/") {
+				delete(g.AllocatedAt, key)
+			}
+		}
+		if gc.Auto.VXLANs != "" {
+			var vxlanRsrcCfg *resources.AutoVXLANCfgResource
+			vxlanRsrcCfg, g.FreeVXLANsStart, err = gc.initVXLANBitset(gc.Auto.VXLANs)
+			if err != nil {
+				return err
+			}
+			// the bitset spans exactly the lowest to the highest vxlan
+			g.VXLANRangeMin = g.FreeVXLANsStart + 1
+			g.VXLANRangeMax = g.FreeVXLANsStart + vxlanRsrcCfg.VXLANs.Len() - 1
+			err = ra.DefineResource("global", resources.AutoVXLANResource, vxlanRsrcCfg)
+			if err != nil {
+				return err
+			}
+		}
 
-	if (reqVxlan != 0) && (reqVxlan >= g.FreeVXLANsStart) {
-		reqVxlan = reqVxlan - g.FreeVXLANsStart
+		err = g.Write()
+		if err != nil {
+			logger.Errorf("error '%s' updating global oper state %v \n", err, g)
+			return err
+		}
 	}
 
-	pair, err1 := ra.AllocateResourceVal("global", resources.AutoVXLANResource, reqVxlan)
-	if err1 != nil {
-		return 0, 0, err1
-	}
+	logger.Debugf("updating the global config to new state %v \n", gc)
+	return nil
+}
 
-	vxlan = pair.(resources.VXLANVLANPair).VXLAN + g.FreeVXLANsStart
-	localVLAN = pair.(resources.VXLANVLANPair).VLAN
+// ReleaseAll returns every allocated vlan, vxlan and local vlan to the free
+// pools, as they were right after Process. Vxlans reserved with SetVXLAN are
+// released as well.
+func (gc *Cfg) ReleaseAll() error {
+	allocMutex.Lock()
+	defer unlockAlloc()
 
-	return
-}
+	vlanCfg, err := gc.readVLANCfg()
+	if core.ErrIfKeyExists(err) != nil {
+		return err
+	}
+	if err == nil {
+		vlanOper, err := gc.readVLANOper()
+		if err != nil {
+			return err
+		}
+		vlanOper.FreeVLANs = vlanCfg.VLANs.Clone()
+		if err := vlanOper.Write(); err != nil {
+			return err
+		}
+	}
 
-// FreeVXLAN returns a VXLAN id to the pool.
-func (gc *Cfg) FreeVXLAN(vxlan uint, localVLAN uint) error {
-	tempRm, err := resources.GetStateResourceManager()
-	if err != nil {
+	vxlanCfg, err := gc.readVXLANCfg()
+	if core.ErrIfKeyExists(err) != nil {
 		return err
 	}
-	ra := core.ResourceManager(tempRm)
+	if err == nil {
+		vxlanOper, err := gc.readVXLANOper()
+		if err != nil {
+			return err
+		}
+		vxlanOper.FreeVXLANs = vxlanCfg.VXLANs.Clone()
+		vxlanOper.FreeLocalVLANs = vxlanCfg.LocalVLANs.Clone()
+		if err := vxlanOper.Write(); err != nil {
+			return err
+		}
+	}
 
-	g := &Oper{}
-	g.StateDriver = gc.StateDriver
+	g := gc.newOper()
 	err = g.Read("")
 	if err != nil {
-		return nil
+		return core.ErrIfKeyExists(err)
 	}
+	g.VXLANLocalVLANs = nil
+	g.ReservedVXLANs = nil
+	g.AllocatedAt = nil
+	g.VLANLeases = nil
 
-	return ra.DeallocateResourceVal("global", resources.AutoVXLANResource,
-		resources.VXLANVLANPair{
-			VXLAN: vxlan - g.FreeVXLANsStart,
-			VLAN:  localVLAN})
+	return g.Write()
 }
 
-func clearReservedVLANs(vlanBitset *bitset.BitSet) {
-	vlanBitset.Clear(0)
-	vlanBitset.Clear(4095)
+// VXLANLocalVLAN pairs a vxlan with the local vlan it is mapped to.
+type VXLANLocalVLAN struct {
+	VXLAN     uint
+	LocalVLAN uint
 }
 
-func (gc *Cfg) initVLANBitset(vlans string) (*bitset.BitSet, error) {
+// AllocatedState carries the vlans and vxlans that are already in use, e.g. by
+// networks that survived a restart.
+type AllocatedState struct {
+	VLANs  []uint
+	VXLANs []VXLANLocalVLAN
+}
 
-	vlanBitset := netutils.CreateBitset(12)
+// ProcessWithState processes the config like Process and then marks the
+// resources in 'used' as allocated, so they are not handed out again.
+func (gc *Cfg) ProcessWithState(res string, used *AllocatedState) error {
+	allocMutex.Lock()
+	defer unlockAlloc()
 
-	vlanRanges, err := netutils.ParseTagRanges(vlans, "vlan")
-	if err != nil {
-		return nil, err
+	err := gc.process(res)
+	if err != nil || used == nil {
+		return err
 	}
 
-	for _, vlanRange := range vlanRanges {
-		for vlan := vlanRange.Min; vlan <= vlanRange.Max; vlan++ {
-			vlanBitset.Set(uint(vlan))
+	if res == "vlan" {
+		for _, vlan := range used.VLANs {
+			if _, err := gc.allocVLAN(vlan); err != nil {
+				return core.Errorf("unable to mark vlan %d in use: %s", vlan, err)
+			}
+		}
+	} else if res == "vxlan" {
+		for _, pair := range used.VXLANs {
+			if _, _, err := gc.allocVXLAN(pair.VXLAN, pair.LocalVLAN); err != nil {
+				return core.Errorf("unable to mark vxlan %d local vlan %d in use: %s",
+					pair.VXLAN, pair.LocalVLAN, err)
+			}
 		}
 	}
-	clearReservedVLANs(vlanBitset)
 
-	return vlanBitset, nil
+	return nil
 }
 
-// GetVlansInUse gets the vlans that are currently in use
-func (gc *Cfg) GetVlansInUse() (uint, string) {
-	tempRm, err := resources.GetStateResourceManager()
-	if err != nil {
-		log.Errorf("error getting resource manager: %s", err)
-		return 0, ""
+// Reconcile marks vlans and vxlans that are known to be in use, e.g. by
+// networks adopted from outside, as allocated so that they are not handed
+// out again. A zero LocalVLAN maps the vxlan to any free local vlan. All
+// the entries are attempted; the errors for the ones that are out of range
+// or already allocated are joined.
+func (gc *Cfg) Reconcile(vlans []uint, vxlans []VXLANLocalVLAN) error {
+	allocMutex.Lock()
+	defer unlockAlloc()
+
+	var errs []error
+	for _, vlan := range vlans {
+		if vlan == 0 {
+			errs = append(errs, core.Errorf("vlan 0 is reserved"))
+			continue
+		}
+		if _, err := gc.allocVLAN(vlan); err != nil {
+			errs = append(errs, fmt.Errorf("vlan %d: %w", vlan, err))
+		}
+	}
+	for _, pair := range vxlans {
+		if pair.VXLAN == 0 {
+			errs = append(errs, core.Errorf("vxlan 0 is reserved"))
+			continue
+		}
+		if _, _, err := gc.allocVXLAN(pair.VXLAN, pair.LocalVLAN); err != nil {
+			errs = append(errs, fmt.Errorf("vxlan %d local vlan %d: %w",
+				pair.VXLAN, pair.LocalVLAN, err))
+		}
 	}
-	ra := core.ResourceManager(tempRm)
 
-	return ra.GetResourceList("global", resources.AutoVLANResource)
+	return errors.Join(errs...)
 }
 
-// AllocVLAN allocates a new VLAN resource. Returns an ID.
-func (gc *Cfg) AllocVLAN(reqVlan uint) (uint, error) {
-	tempRm, err := resources.GetStateResourceManager()
-	if err != nil {
-		return 0, err
+// inTagRanges checks if a tag falls within any of the ranges.
+func inTagRanges(tag uint, tagRanges []netutils.TagRange) bool {
+	for _, tagRange := range tagRanges {
+		if tag >= uint(tagRange.Min) && tag <= uint(tagRange.Max) {
+			return true
+		}
 	}
-	ra := core.ResourceManager(tempRm)
 
-	vlan, err := ra.AllocateResourceVal("global", resources.AutoVLANResource, reqVlan)
-	if err != nil {
-		log.Errorf("alloc vlan failed: %q", err)
-		return 0, err
-	}
+	return false
+}
 
-	return vlan.(uint), err
+// ValidateUpdate checks that the vlans or vxlans currently allocated from the
+// existing resource are still within the ranges of this (updated) config. It
+// returns an error listing the allocations that would be orphaned otherwise.
+func (gc *Cfg) ValidateUpdate(res string) error {
+	allocMutex.RLock()
+	defer allocMutex.RUnlock()
+
+	return gc.validateUpdate(res)
 }
 
-// FreeVLAN releases a VLAN for a given ID.
-func (gc *Cfg) FreeVLAN(vlan uint) error {
-	tempRm, err := resources.GetStateResourceManager()
+func (gc *Cfg) validateUpdate(res string) error {
+	var inUse *bitset.BitSet
+	var tags string
+	var reserved []uint
+	offset := uint(0)
+	if res == "vlan" {
+		cfg, err := gc.readVLANCfg()
+		if err != nil {
+			return core.ErrIfKeyExists(err)
+		}
+		oper, err := gc.readVLANOper()
+		if err != nil {
+			return err
+		}
+		inUse = cfg.VLANs.Difference(oper.FreeVLANs)
+		tags = gc.Auto.VLANs
+		reserved = gc.Auto.ReservedVLANs
+	} else if res == "vxlan" {
+		cfg, err := gc.readVXLANCfg()
+		if err != nil {
+			return core.ErrIfKeyExists(err)
+		}
+		oper, err := gc.readVXLANOper()
+		if err != nil {
+			return err
+		}
+		g := gc.newOper()
+		if err := g.Read(""); err != nil {
+			return err
+		}
+		inUse = cfg.VXLANs.Difference(oper.FreeVXLANs)
+		tags = gc.Auto.VXLANs
+		offset = g.FreeVXLANsStart
+	} else {
+		return nil
+	}
+
+	tagRanges, err := parseTagRanges(tags, res)
 	if err != nil {
 		return err
 	}
-	ra := core.ResourceManager(tempRm)
 
-	return ra.DeallocateResourceVal("global", resources.AutoVLANResource, vlan)
-}
+	orphans := []string{}
+	for idx, ok := inUse.NextSet(0); ok; idx, ok = inUse.NextSet(idx + 1) {
+		if !inTagRanges(idx+offset, tagRanges) {
+			orphans = append(orphans, fmt.Sprintf("%d", idx+offset))
+		}
+	}
+	if len(orphans) > 0 {
+		return core.Errorf("%ss %s are in use and outside the new range %q",
+			res, strings.Join(orphans, ", "), tags)
+	}
+	for _, vlan := range reserved {
+		if inUse.Test(vlan) {
+			orphans = append(orphans, fmt.Sprintf("%d", vlan))
+		}
+	}
+	if len(orphans) > 0 {
+		return core.Errorf("vlans %s are in use and can't be reserved",
+			strings.Join(orphans, ", "))
+	}
 
-// Process validates, implements, and writes the state.
-func (gc *Cfg) Process(res string) error {
-	var err error
+	return nil
+}
 
-	tempRm, err := resources.GetStateResourceManager()
-	if err != nil {
+// ApplyConfig redefines the vlan or vxlan (per res) resource with the ranges
+// of this updated config, e.g. to expand a pool, keeping all the current
+// allocations. The update is rejected, leaving the state untouched, if any
+// current allocation falls outside the new ranges; if redefining the
+// resource fails, the previous resource is restored.
+func (gc *Cfg) ApplyConfig(res string) (err error) {
+	if err := gc.checkErrors(res); err != nil {
 		return err
 	}
 
-	ra := core.ResourceManager(tempRm)
+	allocMutex.Lock()
+	defer unlockAlloc()
 
-	err = gc.checkErrors(res)
-	if err != nil {
-		return core.Errorf("process failed on error checks %s", err)
+	if err := gc.validateUpdate(res); err != nil {
+		return err
 	}
 
-	// Only define a vlan resource if a valid range was specified
+	g := gc.newOper()
+	err = g.Read("")
+	if core.ErrIfKeyExists(err) != nil {
+		return err
+	}
+	operExists := err == nil
+
+	// the resource state deleted below, put back if the update fails
+	var previous []core.State
+	defer func() {
+		if err != nil && previous != nil {
+			gc.restoreResource(res, previous)
+		}
+	}()
+
 	if res == "vlan" {
-		if gc.Auto.VLANs != "" {
-			var vlanRsrcCfg *bitset.BitSet
-			vlanRsrcCfg, err = gc.initVLANBitset(gc.Auto.VLANs)
+		inUse := bitset.New(0)
+		vlanCfg, err := gc.readVLANCfg()
+		if core.ErrIfKeyExists(err) != nil {
+			return err
+		}
+		if err == nil {
+			vlanOper, err := gc.readVLANOper()
 			if err != nil {
 				return err
 			}
-			err = ra.DefineResource("global", resources.AutoVLANResource, vlanRsrcCfg)
-			if err != nil {
+			inUse = vlanCfg.VLANs.Difference(vlanOper.FreeVLANs)
+			if err := gc.DeleteResources(res); err != nil {
 				return err
 			}
+			previous = []core.State{vlanCfg, vlanOper}
 		}
-	}
-	// Only define a vxlan resource if a valid range was specified
-	var freeVXLANsStart uint
-	if res == "vxlan" {
-		if gc.Auto.VXLANs != "" {
-			var vxlanRsrcCfg *resources.AutoVXLANCfgResource
-			vxlanRsrcCfg, freeVXLANsStart, err = gc.initVXLANBitset(gc.Auto.VXLANs)
+
+		if err := gc.process(res); err != nil {
+			return err
+		}
+		if gc.Auto.VLANs == "" {
+			return nil
+		}
+
+		vlanOper, err := gc.readVLANOper()
+		if err != nil {
+			return err
+		}
+		vlanOper.FreeVLANs.InPlaceDifference(inUse)
+		return vlanOper.Write()
+	} else if res == "vxlan" {
+		inUse := []uint{}
+		inUseLocal := bitset.New(0)
+		vxlanCfg, err := gc.readVXLANCfg()
+		if core.ErrIfKeyExists(err) != nil {
+			return err
+		}
+		if err == nil {
+			vxlanOper, err := gc.readVXLANOper()
 			if err != nil {
 				return err
 			}
-			err = ra.DefineResource("global", resources.AutoVXLANResource, vxlanRsrcCfg)
-			if err != nil {
+			used := vxlanCfg.VXLANs.Difference(vxlanOper.FreeVXLANs)
+			for idx, ok := used.NextSet(0); ok; idx, ok = used.NextSet(idx + 1) {
+				inUse = append(inUse, idx+g.FreeVXLANsStart)
+			}
+			inUseLocal = vxlanCfg.LocalVLANs.Difference(vxlanOper.FreeLocalVLANs)
+			if err := gc.DeleteResources(res); err != nil {
 				return err
 			}
+			previous = []core.State{vxlanCfg, vxlanOper}
+			if operExists {
+				previous = append(previous, g)
+			}
 		}
 
-		g := &Oper{FreeVXLANsStart: freeVXLANsStart}
+		if err := gc.process(res); err != nil {
+			return err
+		}
 
-		g.StateDriver = gc.StateDriver
-		err = g.Write()
+		// Process rewrites the oper state; carry over what it doesn't own
+		newG := gc.newOper()
+		if err := newG.Read(""); err != nil {
+			return err
+		}
+		newG.DefaultNetwork = g.DefaultNetwork
+		newG.VXLANLocalVLANs = g.VXLANLocalVLANs
+		newG.ReservedVXLANs = g.ReservedVXLANs
+		newG.AllocatedAt = g.AllocatedAt
+		newG.VLANLeases = g.VLANLeases
+		if err := newG.Write(); err != nil {
+			return err
+		}
+		if gc.Auto.VXLANs == "" {
+			return nil
+		}
+
+		vxlanOper, err := gc.readVXLANOper()
 		if err != nil {
-			log.Errorf("error '%s' updating global oper state %v \n", err, g)
 			return err
 		}
+		for _, vxlan := range inUse {
+			vxlanOper.FreeVXLANs.Clear(vxlan - newG.FreeVXLANsStart)
+		}
+		vxlanOper.FreeLocalVLANs.InPlaceDifference(inUseLocal)
+		return vxlanOper.Write()
 	}
 
-	log.Debugf("updating the global config to new state %v \n", gc)
 	return nil
 }
 
+// restoreResource puts back the vlan or vxlan (per res) resource state saved
+// before a failed ApplyConfig, dropping whatever was defined since.
+func (gc *Cfg) restoreResource(res string, previous []core.State) {
+	gc.DeleteResources(res)
+	for _, state := range previous {
+		if err := state.Write(); err != nil {
+			logger.Errorf("error restoring the %s resource state: %s", res, err)
+		}
+	}
+}
+
 // DeleteResources deletes associated resources
 func (gc *Cfg) DeleteResources(res string) error {
 	tempRm, err := resources.GetStateResourceManager()
@@ -378,13 +2868,13 @@ func (gc *Cfg) DeleteResources(res string) error {
 	if res == "vlan" {
 		err = ra.UndefineResource("global", resources.AutoVLANResource)
 		if err != nil {
-			log.Errorf("Error deleting vlan resource. Err: %v", err)
+			logger.Errorf("Error deleting vlan resource. Err: %v", err)
 		}
 	} else if res == "vxlan" {
 
 		err = ra.UndefineResource("global", resources.AutoVXLANResource)
 		if err != nil {
-			log.Errorf("Error deleting vxlan resource. Err: %v", err)
+			logger.Errorf("Error deleting vxlan resource. Err: %v", err)
 		}
 	}
 	return err
@@ -394,8 +2884,10 @@ func (gc *Cfg) DeleteResources(res string) error {
 // in case configuration is absent it uses the provided network name to be the default
 // network. It records the default network in oper state (derived or configured)
 func (gc *Cfg) AssignDefaultNetwork(networkName string) (string, error) {
-	g := &Oper{}
-	g.StateDriver = gc.StateDriver
+	allocMutex.Lock()
+	defer unlockAlloc()
+
+	g := gc.newOper()
 	if err := g.Read(""); core.ErrIfKeyExists(err) != nil {
 		return "", err
 	}
@@ -407,7 +2899,7 @@ func (gc *Cfg) AssignDefaultNetwork(networkName string) (string, error) {
 	g.DefaultNetwork = networkName
 
 	if err := g.Write(); err != nil {
-		log.Errorf("error '%s' updating goper state %v \n", err, g)
+		logger.Errorf("error '%s' updating goper state %v \n", err, g)
 		return "", err
 	}
 
@@ -420,8 +2912,10 @@ func (gc *Cfg) UnassignNetwork(networkName string) error {
 		return nil
 	}
 
-	g := &Oper{}
-	g.StateDriver = gc.StateDriver
+	allocMutex.Lock()
+	defer unlockAlloc()
+
+	g := gc.newOper()
 	if err := g.Read(""); core.ErrIfKeyExists(err) != nil {
 		return err
 	}
@@ -429,7 +2923,7 @@ func (gc *Cfg) UnassignNetwork(networkName string) error {
 	if networkName == g.DefaultNetwork {
 		g.DefaultNetwork = ""
 		if err := g.Write(); err != nil {
-			log.Errorf("error '%s' updating goper state %v \n", err, g)
+			logger.Errorf("error '%s' updating goper state %v \n", err, g)
 			return err
 		}
 	}
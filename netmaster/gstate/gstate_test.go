@@ -16,10 +16,24 @@ limitations under the License.
 package gstate
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/jainvipin/bitset"
+
+	"github.com/contiv/netplugin/core"
+	"github.com/contiv/netplugin/netmaster/mastercfg"
 	"github.com/contiv/netplugin/netmaster/resources"
 	"github.com/contiv/netplugin/state"
+	"github.com/contiv/netplugin/utils/netutils"
 )
 
 var (
@@ -330,3 +344,3332 @@ func TestAutoDefaultNetwork(t *testing.T) {
 		t.Fatalf("Error: '%s' could not unassign default network", err)
 	}
 }
+
+// setupGlobalConfig parses cfgData, instantiates the resource manager and
+// processes the vlan and vxlan resources. The returned func undoes the setup.
+func setupGlobalConfig(t *testing.T, cfgData []byte) (*Cfg, func()) {
+	gc, err := Parse(cfgData)
+	if err != nil {
+		t.Fatalf("error '%s' parsing config '%s' \n", err, cfgData)
+	}
+
+	gstateSD.Init(nil)
+	gc.StateDriver = gstateSD
+	_, err = resources.NewStateResourceManager(gstateSD)
+	if err != nil {
+		gstateSD.Deinit()
+		t.Fatalf("Failed to instantiate resource manager. Error: %s", err)
+	}
+	cleanup := func() {
+		resources.ReleaseStateResourceManager()
+		gstateSD.Deinit()
+	}
+
+	for _, res := range []string{"vlan", "vxlan"} {
+		if err := gc.Process(res); err != nil {
+			cleanup()
+			t.Fatalf("error '%s' processing config %v \n", err, gc)
+		}
+	}
+
+	return gc, cleanup
+}
+
+func TestAllocVLANInRange(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-300",
+                "VXLANs"            : "10000-10100"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	for _, exp := range []uint{200, 201} {
+		vlan, err := gc.AllocVLANInRange(200, 201)
+		if err != nil {
+			t.Fatalf("error - allocating vlan in range - %s \n", err)
+		}
+		if vlan != exp {
+			t.Fatalf("error - expecting vlan %d but allocated %d \n", exp, vlan)
+		}
+	}
+
+	if _, err := gc.AllocVLANInRange(200, 201); err == nil {
+		t.Fatalf("error - able to allocate vlan from exhausted range")
+	}
+	if _, err := gc.AllocVLANInRange(201, 200); err == nil {
+		t.Fatalf("error - able to allocate vlan with min greater than max")
+	}
+	if _, err := gc.AllocVLANInRange(0, 5000); err == nil {
+		t.Fatalf("error - able to allocate vlan outside 1-4094")
+	}
+
+	vlan, err := gc.AllocVLAN(uint(0))
+	if err != nil {
+		t.Fatalf("error - allocating vlan - %s \n", err)
+	}
+	if vlan != 1 {
+		t.Fatalf("error - expecting vlan %d but allocated %d \n", 1, vlan)
+	}
+}
+
+func TestSetVXLAN(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-10",
+                "VXLANs"            : "10000-10002"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	if err := gc.SetVXLAN(10000); err != nil {
+		t.Fatalf("error reserving vxlan 10000 - %s \n", err)
+	}
+	if err := gc.SetVXLAN(10000); err == nil {
+		t.Fatalf("error - able to reserve vxlan 10000 twice")
+	}
+	if err := gc.SetVXLAN(9999); err == nil {
+		t.Fatalf("error - able to reserve vxlan outside the configured range")
+	}
+
+	vxlan, _, err := gc.AllocVXLAN(uint(0))
+	if err != nil {
+		t.Fatalf("error - allocating vxlan - %s \n", err)
+	}
+	if vxlan != 10001 {
+		t.Fatalf("error - expecting vxlan %d but allocated %d \n", 10001, vxlan)
+	}
+	if _, _, err := gc.AllocVXLAN(10000); err == nil {
+		t.Fatalf("error - able to allocate reserved vxlan 10000")
+	}
+}
+
+func TestNumFreeAndTotal(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-10",
+                "VXLANs"            : "10000-10002"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	if _, err := gc.AllocVLAN(uint(0)); err != nil {
+		t.Fatalf("error - allocating vlan - %s \n", err)
+	}
+	if _, _, err := gc.AllocVXLAN(uint(0)); err != nil {
+		t.Fatalf("error - allocating vxlan - %s \n", err)
+	}
+
+	counts := []struct {
+		name string
+		fn   func() (uint, error)
+		exp  uint
+	}{
+		{"free vlans", gc.NumFreeVLANs, 9},
+		{"total vlans", gc.NumTotalVLANs, 10},
+		{"free vxlans", gc.NumFreeVXLANs, 2},
+		{"total vxlans", gc.NumTotalVXLANs, 3},
+	}
+	for _, c := range counts {
+		num, err := c.fn()
+		if err != nil {
+			t.Fatalf("error getting %s - %s \n", c.name, err)
+		}
+		if num != c.exp {
+			t.Fatalf("error - expecting %d %s but got %d \n", c.exp, c.name, num)
+		}
+	}
+}
+
+func TestConcurrentAllocVLAN(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-200",
+                "VXLANs"            : "10000-10100"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	var wg sync.WaitGroup
+	vlans := make(chan uint, 100)
+	errs := make(chan error, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			vlan, err := gc.AllocVLAN(uint(0))
+			if err != nil {
+				errs <- err
+				return
+			}
+			vlans <- vlan
+		}()
+	}
+	wg.Wait()
+	close(vlans)
+	close(errs)
+
+	for err := range errs {
+		t.Fatalf("error - allocating vlan - %s \n", err)
+	}
+	seen := map[uint]bool{}
+	for vlan := range vlans {
+		if seen[vlan] {
+			t.Fatalf("error - vlan %d allocated more than once \n", vlan)
+		}
+		seen[vlan] = true
+	}
+	if len(seen) != 100 {
+		t.Fatalf("error - expecting %d vlans but allocated %d \n", 100, len(seen))
+	}
+}
+
+func TestReadAllOper(t *testing.T) {
+	gstateSD.Init(nil)
+	defer func() { gstateSD.Deinit() }()
+
+	g := &Oper{DefaultNetwork: "orange", FreeVXLANsStart: 9999}
+	g.StateDriver = gstateSD
+	if err := g.Write(); err != nil {
+		t.Fatalf("error writing oper state - %s \n", err)
+	}
+
+	opers, err := ReadAllOper(gstateSD)
+	if err != nil {
+		t.Fatalf("error reading all oper state - %s \n", err)
+	}
+	if len(opers) != 1 {
+		t.Fatalf("error - expecting %d oper states but read %d \n", 1, len(opers))
+	}
+	if opers[0].DefaultNetwork != "orange" || opers[0].FreeVXLANsStart != 9999 {
+		t.Fatalf("error - read oper state %+v doesn't match written %+v \n", opers[0], g)
+	}
+	if opers[0].StateDriver == nil {
+		t.Fatalf("error - state driver not set on read oper state")
+	}
+}
+
+func TestDeleteGlobalState(t *testing.T) {
+	gstateSD.Init(nil)
+	defer func() { gstateSD.Deinit() }()
+
+	gc := &Cfg{Auto: AutoParams{VLANs: "1-10"}}
+	gc.StateDriver = gstateSD
+	if err := gc.Write(); err != nil {
+		t.Fatalf("error writing config state - %s \n", err)
+	}
+	g := &Oper{DefaultNetwork: "orange"}
+	g.StateDriver = gstateSD
+	if err := g.Write(); err != nil {
+		t.Fatalf("error writing oper state - %s \n", err)
+	}
+
+	if err := DeleteGlobalState(gstateSD); err != nil {
+		t.Fatalf("error deleting global state - %s \n", err)
+	}
+	if err := gc.Read(""); err == nil {
+		t.Fatalf("error - global config state still exists after delete")
+	}
+	if err := g.Read(""); err == nil {
+		t.Fatalf("error - global oper state still exists after delete")
+	}
+
+	// deleting again must be a no-op so partial failures can be retried
+	if err := DeleteGlobalState(gstateSD); err != nil {
+		t.Fatalf("error deleting absent global state - %s \n", err)
+	}
+}
+
+func TestInvalidGlobalConfigReservedVLANs(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "4090-4095",
+                "VXLANs"            : "10000-10001"
+            }
+        }`)
+
+	_, err := Parse(cfgData)
+	if err == nil {
+		t.Fatalf("Error: was able to parse vlan pool with reserved vlan '%s'", cfgData)
+	}
+}
+
+func TestProcessWithState(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-10",
+                "VXLANs"            : "10000-10010"
+            }
+        }`)
+
+	gc, err := Parse(cfgData)
+	if err != nil {
+		t.Fatalf("error '%s' parsing config '%s' \n", err, cfgData)
+	}
+
+	gstateSD.Init(nil)
+	defer func() { gstateSD.Deinit() }()
+	gc.StateDriver = gstateSD
+	_, err = resources.NewStateResourceManager(gstateSD)
+	if err != nil {
+		t.Fatalf("Failed to instantiate resource manager. Error: %s", err)
+	}
+	defer func() { resources.ReleaseStateResourceManager() }()
+
+	used := &AllocatedState{
+		VLANs:  []uint{1, 2},
+		VXLANs: []VXLANLocalVLAN{{VXLAN: 10000, LocalVLAN: 1}},
+	}
+	for _, res := range []string{"vlan", "vxlan"} {
+		if err := gc.ProcessWithState(res, used); err != nil {
+			t.Fatalf("error '%s' processing config %v \n", err, gc)
+		}
+	}
+
+	vlan, err := gc.AllocVLAN(uint(0))
+	if err != nil {
+		t.Fatalf("error - allocating vlan - %s \n", err)
+	}
+	if vlan != 3 {
+		t.Fatalf("error - expecting vlan %d but allocated %d \n", 3, vlan)
+	}
+
+	vxlan, localVLAN, err := gc.AllocVXLAN(uint(0))
+	if err != nil {
+		t.Fatalf("error - allocating vxlan - %s \n", err)
+	}
+	if vxlan != 10001 || localVLAN != 2 {
+		t.Fatalf("error - expecting vxlan %d local vlan %d but allocated %d/%d \n",
+			10001, 2, vxlan, localVLAN)
+	}
+}
+
+func TestAllocErrors(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-1",
+                "VXLANs"            : "10000-10000"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	if _, err := gc.AllocVLAN(uint(0)); err != nil {
+		t.Fatalf("error - allocating vlan - %s \n", err)
+	}
+	if _, err := gc.AllocVLAN(uint(1)); !errors.Is(err, ErrVLANUnavailable) {
+		t.Fatalf("error - expecting %q but got %v \n", ErrVLANUnavailable, err)
+	}
+	_, err := gc.AllocVLAN(uint(0))
+	if !errors.Is(err, ErrVLANExhausted) {
+		t.Fatalf("error - expecting %q but got %v \n", ErrVLANExhausted, err)
+	}
+	if !strings.Contains(err.Error(), `vlan pool "global" has 0 free`) {
+		t.Fatalf("error - expecting the pool and free count in %q \n", err)
+	}
+	if _, err := gc.AllocVLANInRange(1, 10); !errors.Is(err, ErrVLANExhausted) {
+		t.Fatalf("error - expecting %q but got %v \n", ErrVLANExhausted, err)
+	}
+
+	if _, _, err := gc.AllocVXLAN(uint(9000)); !errors.Is(err, ErrVXLANOutOfRange) {
+		t.Fatalf("error - expecting %q but got %v \n", ErrVXLANOutOfRange, err)
+	}
+	if _, _, err := gc.AllocVXLAN(uint(0)); err != nil {
+		t.Fatalf("error - allocating vxlan - %s \n", err)
+	}
+	if _, _, err := gc.AllocVXLAN(uint(0)); !errors.Is(err, ErrVXLANExhausted) {
+		t.Fatalf("error - expecting %q but got %v \n", ErrVXLANExhausted, err)
+	}
+}
+
+func TestCfgDiff(t *testing.T) {
+	oldCfg := &Cfg{Auto: AutoParams{VLANs: "1-100", VXLANs: "10000-10100"}}
+	newCfg := &Cfg{Auto: AutoParams{VLANs: "1-200", VXLANs: "10000-10100"}}
+
+	diffs := oldCfg.Diff(newCfg)
+	if len(diffs) != 1 || diffs[0] != "Auto.VLANs: 1-100 -> 1-200" {
+		t.Fatalf("error - unexpected diff %q \n", diffs)
+	}
+	if diffs := oldCfg.Diff(oldCfg); len(diffs) != 0 {
+		t.Fatalf("error - unexpected diff %q for identical configs \n", diffs)
+	}
+}
+
+func TestValidateUpdate(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-10",
+                "VXLANs"            : "10000-10010"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	if _, err := gc.AllocVLAN(uint(5)); err != nil {
+		t.Fatalf("error - allocating vlan - %s \n", err)
+	}
+	if _, _, err := gc.AllocVXLAN(uint(10005)); err != nil {
+		t.Fatalf("error - allocating vxlan - %s \n", err)
+	}
+
+	newCfg := &Cfg{Auto: AutoParams{VLANs: "1-4", VXLANs: "10000-10004"}}
+	newCfg.StateDriver = gstateSD
+	if err := newCfg.ValidateUpdate("vlan"); err == nil {
+		t.Fatalf("error - shrinking vlan range orphaning vlan 5 was allowed")
+	}
+	if err := newCfg.ValidateUpdate("vxlan"); err == nil {
+		t.Fatalf("error - shrinking vxlan range orphaning vxlan 10005 was allowed")
+	}
+
+	newCfg.Auto = AutoParams{VLANs: "1-20", VXLANs: "10005-10020"}
+	if err := newCfg.ValidateUpdate("vlan"); err != nil {
+		t.Fatalf("error validating vlan range update - %s \n", err)
+	}
+	if err := newCfg.ValidateUpdate("vxlan"); err != nil {
+		t.Fatalf("error validating vxlan range update - %s \n", err)
+	}
+}
+
+func TestAllocVXLANContiguous(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-10",
+                "VXLANs"            : "10000-10005"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	// leave 10000, 10002-10003 and 10005 free
+	for _, vxlan := range []uint{10001, 10004} {
+		if _, _, err := gc.AllocVXLAN(vxlan); err != nil {
+			t.Fatalf("error - allocating vxlan %d - %s \n", vxlan, err)
+		}
+	}
+
+	start, localVLANs, err := gc.AllocVXLANContiguous(2)
+	if err != nil {
+		t.Fatalf("error - allocating contiguous vxlans - %s \n", err)
+	}
+	if start != 10002 || len(localVLANs) != 2 {
+		t.Fatalf("error - expecting vxlans from %d but allocated from %d (%v) \n",
+			10002, start, localVLANs)
+	}
+
+	if _, _, err := gc.AllocVXLANContiguous(2); err == nil {
+		t.Fatalf("error - allocated contiguous vxlans from scattered free vxlans")
+	}
+	numFree, err := gc.NumFreeVXLANs()
+	if err != nil {
+		t.Fatalf("error getting free vxlans - %s \n", err)
+	}
+	if numFree != 2 {
+		t.Fatalf("error - expecting %d free vxlans but got %d \n", 2, numFree)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	gc := &Cfg{Auto: AutoParams{VLANs: "1-100", VXLANs: "10000-10100"}}
+	if err := ValidateConfig(gc); err != nil {
+		t.Fatalf("error validating config %+v - %s \n", gc, err)
+	}
+
+	gc.Auto.VXLANs = "10100-10000"
+	if err := ValidateConfig(gc); err == nil {
+		t.Fatalf("error - invalid vxlan range in config %+v passed validation", gc)
+	}
+
+	gc.Auto.VLANs = "1-5000"
+	err := ValidateConfig(gc)
+	if err == nil {
+		t.Fatalf("error - invalid ranges in config %+v passed validation", gc)
+	}
+	if !strings.Contains(err.Error(), "1-5000") || !strings.Contains(err.Error(), "10100-10000") {
+		t.Fatalf("error - expecting both vlan and vxlan errors but got '%s' \n", err)
+	}
+}
+
+func TestFreeVXLANOutOfRange(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-10",
+                "VXLANs"            : "10000-10010"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	vxlan, localVLAN, err := gc.AllocVXLAN(uint(0))
+	if err != nil {
+		t.Fatalf("error - allocating vxlan - %s \n", err)
+	}
+
+	invalid := []struct {
+		vxlan, localVLAN uint
+	}{
+		{1, localVLAN},
+		{9999, localVLAN},
+		{10011, localVLAN},
+		{100000, localVLAN},
+		{vxlan, 0},
+		{vxlan, 4095},
+	}
+	for _, inv := range invalid {
+		if err := gc.FreeVXLAN(inv.vxlan, inv.localVLAN); err == nil {
+			t.Fatalf("error - able to free vxlan %d local vlan %d \n", inv.vxlan, inv.localVLAN)
+		}
+	}
+
+	if err := gc.FreeVXLAN(vxlan, localVLAN); err != nil {
+		t.Fatalf("error freeing allocated vxlan %d localvlan %d - err '%s' \n",
+			vxlan, localVLAN, err)
+	}
+}
+
+func TestThresholdCallback(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-10",
+                "VXLANs"            : "10000-10003"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	fired := []string{}
+	gc.OnThreshold = func(resource string, pct float64) {
+		fired = append(fired, resource)
+	}
+	gc.ThresholdPct = 50
+
+	// 10 vlans: the threshold is crossed on the 6th allocation
+	for i := 0; i < 6; i++ {
+		if _, err := gc.AllocVLAN(uint(0)); err != nil {
+			t.Fatalf("error - allocating vlan - %s \n", err)
+		}
+		if i < 5 && len(fired) != 0 {
+			t.Fatalf("error - threshold callback invoked after %d vlans \n", i+1)
+		}
+	}
+	if len(fired) != 1 || fired[0] != "vlan" {
+		t.Fatalf("error - expecting vlan threshold callback but got %v \n", fired)
+	}
+
+	// 4 vxlans: the threshold is crossed on the 3rd allocation
+	for i := 0; i < 3; i++ {
+		if _, _, err := gc.AllocVXLAN(uint(0)); err != nil {
+			t.Fatalf("error - allocating vxlan - %s \n", err)
+		}
+	}
+	if len(fired) != 2 || fired[1] != "vxlan" {
+		t.Fatalf("error - expecting vxlan threshold callback but got %v \n", fired)
+	}
+}
+
+func TestOperBitsetJSONRoundTrip(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-100",
+                "VXLANs"            : "10000-10100"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	for _, vlan := range []uint{1, 50, 100} {
+		if _, err := gc.AllocVLAN(vlan); err != nil {
+			t.Fatalf("error - allocating vlan %d - %s \n", vlan, err)
+		}
+	}
+	for _, vxlan := range []uint{10000, 10064, 10100} {
+		if _, _, err := gc.AllocVXLAN(vxlan); err != nil {
+			t.Fatalf("error - allocating vxlan %d - %s \n", vxlan, err)
+		}
+	}
+
+	vlanOper, err := gc.readVLANOper()
+	if err != nil {
+		t.Fatalf("error reading vlan oper state - %s \n", err)
+	}
+	data, err := json.Marshal(vlanOper)
+	if err != nil {
+		t.Fatalf("error marshaling vlan oper state - %s \n", err)
+	}
+	readVLANOper := &resources.AutoVLANOperResource{}
+	if err := json.Unmarshal(data, readVLANOper); err != nil {
+		t.Fatalf("error unmarshaling vlan oper state - %s \n", err)
+	}
+	if !readVLANOper.FreeVLANs.Equal(vlanOper.FreeVLANs) {
+		t.Fatalf("error - free vlans %s don't match %s after round trip \n",
+			readVLANOper.FreeVLANs.DumpAsBits(), vlanOper.FreeVLANs.DumpAsBits())
+	}
+
+	vxlanOper, err := gc.readVXLANOper()
+	if err != nil {
+		t.Fatalf("error reading vxlan oper state - %s \n", err)
+	}
+	data, err = json.Marshal(vxlanOper)
+	if err != nil {
+		t.Fatalf("error marshaling vxlan oper state - %s \n", err)
+	}
+	readVXLANOper := &resources.AutoVXLANOperResource{}
+	if err := json.Unmarshal(data, readVXLANOper); err != nil {
+		t.Fatalf("error unmarshaling vxlan oper state - %s \n", err)
+	}
+	if !readVXLANOper.FreeVXLANs.Equal(vxlanOper.FreeVXLANs) ||
+		!readVXLANOper.FreeLocalVLANs.Equal(vxlanOper.FreeLocalVLANs) {
+		t.Fatalf("error - free vxlans/local vlans don't match after round trip \n")
+	}
+}
+
+func TestReleaseAll(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-10",
+                "VXLANs"            : "10000-10010"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	for i := 0; i < 3; i++ {
+		if _, err := gc.AllocVLAN(uint(0)); err != nil {
+			t.Fatalf("error - allocating vlan - %s \n", err)
+		}
+		if _, _, err := gc.AllocVXLAN(uint(0)); err != nil {
+			t.Fatalf("error - allocating vxlan - %s \n", err)
+		}
+	}
+
+	if err := gc.ReleaseAll(); err != nil {
+		t.Fatalf("error releasing all resources - %s \n", err)
+	}
+
+	for _, res := range []string{"vlan", "vxlan"} {
+		free, used, err := gc.poolUsage(res)
+		if err != nil {
+			t.Fatalf("error getting %s pool usage - %s \n", res, err)
+		}
+		if used != 0 {
+			t.Fatalf("error - expecting all %ss free but %d of %d are used \n", res, used, free+used)
+		}
+	}
+
+	vlan, err := gc.AllocVLAN(uint(0))
+	if err != nil {
+		t.Fatalf("error - allocating vlan - %s \n", err)
+	}
+	if vlan != 1 {
+		t.Fatalf("error - expecting vlan %d but allocated %d \n", 1, vlan)
+	}
+	vxlan, localVLAN, err := gc.AllocVXLAN(uint(0))
+	if err != nil {
+		t.Fatalf("error - allocating vxlan - %s \n", err)
+	}
+	if vxlan != 10000 || localVLAN != 1 {
+		t.Fatalf("error - expecting vxlan %d local vlan %d but allocated %d/%d \n",
+			10000, 1, vxlan, localVLAN)
+	}
+}
+
+func TestGlobalConfigMultipleVXLANRanges(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-10",
+                "VXLANs"            : "20000-20001,10000-10001"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	for _, exp := range []uint{10000, 10001, 20000, 20001} {
+		vxlan, _, err := gc.AllocVXLAN(uint(0))
+		if err != nil {
+			t.Fatalf("error - allocating vxlan - %s \n", err)
+		}
+		if vxlan != exp {
+			t.Fatalf("error - expecting vxlan %d but allocated %d \n", exp, vxlan)
+		}
+	}
+
+	if _, _, err := gc.AllocVXLAN(uint(0)); err == nil {
+		t.Fatalf("error - allocated vxlan outside the configured ranges")
+	}
+}
+
+func TestCapacities(t *testing.T) {
+	gc := &Cfg{Auto: AutoParams{VLANs: "1-100,200-299", VXLANs: "10000-10999"}}
+
+	vlans, vxlans, err := gc.Capacities()
+	if err != nil {
+		t.Fatalf("error getting capacities of config %+v - %s \n", gc, err)
+	}
+	if vlans != 200 || vxlans != 1000 {
+		t.Fatalf("error - expecting %d vlans and %d vxlans but got %d and %d \n",
+			200, 1000, vlans, vxlans)
+	}
+
+	gc.Auto.VXLANs = ""
+	if _, vxlans, err = gc.Capacities(); err != nil || vxlans != 0 {
+		t.Fatalf("error - expecting no vxlans but got %d (err: %v) \n", vxlans, err)
+	}
+}
+
+// blockingStateDriver never completes a state write.
+type blockingStateDriver struct {
+	state.FakeStateDriver
+}
+
+func (d *blockingStateDriver) WriteState(key string, value core.State,
+	marshal func(interface{}) ([]byte, error)) error {
+	select {}
+}
+
+func TestStateContext(t *testing.T) {
+	gc := &Cfg{Auto: AutoParams{VLANs: "1-10"}}
+	gc.StateDriver = &blockingStateDriver{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := gc.WriteContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("error - expecting write to time out but got %v \n", err)
+	}
+
+	gstateSD.Init(nil)
+	defer func() { gstateSD.Deinit() }()
+	gc.StateDriver = gstateSD
+
+	if err := gc.WriteContext(context.Background()); err != nil {
+		t.Fatalf("error writing config state - %s \n", err)
+	}
+	readCfg := &Cfg{}
+	readCfg.StateDriver = gstateSD
+	if err := readCfg.ReadContext(context.Background(), ""); err != nil {
+		t.Fatalf("error reading config state - %s \n", err)
+	}
+	if readCfg.Auto.VLANs != "1-10" {
+		t.Fatalf("error - read config %+v doesn't match written %+v \n", readCfg, gc)
+	}
+	if err := readCfg.ClearContext(context.Background()); err != nil {
+		t.Fatalf("error clearing config state - %s \n", err)
+	}
+}
+
+type testObserver struct {
+	events []Event
+}
+
+func (o *testObserver) Notify(ev Event) {
+	o.events = append(o.events, ev)
+}
+
+func TestAllocEvents(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-10",
+                "VXLANs"            : "10000-10010"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	observer := &testObserver{}
+	gc.Observer = observer
+
+	vlan, err := gc.AllocVLAN(uint(0))
+	if err != nil {
+		t.Fatalf("error - allocating vlan - %s \n", err)
+	}
+	vxlan, localVLAN, err := gc.AllocVXLAN(uint(0))
+	if err != nil {
+		t.Fatalf("error - allocating vxlan - %s \n", err)
+	}
+	if err := gc.FreeVXLAN(vxlan, localVLAN); err != nil {
+		t.Fatalf("error freeing vxlan - %s \n", err)
+	}
+	if err := gc.FreeVLAN(vlan); err != nil {
+		t.Fatalf("error freeing vlan - %s \n", err)
+	}
+	// freeing again reports no events
+	if err := gc.FreeVXLAN(vxlan, localVLAN); err != nil {
+		t.Fatalf("error freeing vxlan twice - %s \n", err)
+	}
+	if err := gc.FreeVLAN(vlan); err != nil {
+		t.Fatalf("error freeing vlan twice - %s \n", err)
+	}
+	if _, err := gc.AllocVLAN(uint(100)); err == nil {
+		t.Fatalf("error - allocated vlan outside the configured range")
+	}
+
+	expEvents := []Event{
+		{Resource: "vlan", Op: EventAlloc, Value: 1},
+		{Resource: "vxlan", Op: EventAlloc, Value: 10000, LocalVLAN: 1},
+		{Resource: "vxlan", Op: EventFree, Value: 10000, LocalVLAN: 1},
+		{Resource: "vlan", Op: EventFree, Value: 1},
+	}
+	if len(observer.events) != len(expEvents) {
+		t.Fatalf("error - expecting events %+v but got %+v \n", expEvents, observer.events)
+	}
+	for i, ev := range expEvents {
+		if observer.events[i] != ev {
+			t.Fatalf("error - expecting event %+v but got %+v \n", ev, observer.events[i])
+		}
+	}
+}
+
+func TestDumpJSON(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-10",
+                "VXLANs"            : "10000-10010"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	out, err := gc.DumpJSON()
+	if err != nil {
+		t.Fatalf("error dumping config - %s \n", err)
+	}
+	cfg := &Cfg{}
+	if err := json.Unmarshal(out, cfg); err != nil {
+		t.Fatalf("error parsing dumped config %s - %s \n", out, err)
+	}
+	if !reflect.DeepEqual(cfg.Auto, gc.Auto) {
+		t.Fatalf("error - expecting config %+v but got %+v \n", gc.Auto, cfg.Auto)
+	}
+
+	if _, err := gc.AllocVLAN(uint(0)); err != nil {
+		t.Fatalf("error - allocating vlan - %s \n", err)
+	}
+
+	g := &Oper{}
+	g.StateDriver = gstateSD
+	if err := g.Read(""); err != nil {
+		t.Fatalf("error reading oper state - %s \n", err)
+	}
+	out, err = g.DumpJSON()
+	if err != nil {
+		t.Fatalf("error dumping oper state - %s \n", err)
+	}
+	dump := map[string]interface{}{}
+	if err := json.Unmarshal(out, &dump); err != nil {
+		t.Fatalf("error parsing dumped oper state %s - %s \n", out, err)
+	}
+	if dump["freeVLANs"] != float64(9) || dump["freeVXLANs"] != float64(11) {
+		t.Fatalf("error - unexpected free counts in %s \n", out)
+	}
+}
+
+func TestDumpJSONSinglePool(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VXLANs"            : "10000-10010"
+            }
+        }`)
+
+	_, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	g := &Oper{}
+	g.StateDriver = gstateSD
+	if err := g.Read(""); err != nil {
+		t.Fatalf("error reading oper state - %s \n", err)
+	}
+	out, err := g.DumpJSON()
+	if err != nil {
+		t.Fatalf("error dumping oper state - %s \n", err)
+	}
+	dump := map[string]interface{}{}
+	if err := json.Unmarshal(out, &dump); err != nil {
+		t.Fatalf("error parsing dumped oper state %s - %s \n", out, err)
+	}
+	if dump["freeVLANs"] != float64(0) || dump["freeVXLANs"] != float64(11) {
+		t.Fatalf("error - unexpected free counts in %s \n", out)
+	}
+}
+
+// watchStateDriver replays the configured updates to watchers and then
+// blocks until the watch is stopped.
+type watchStateDriver struct {
+	state.FakeStateDriver
+	updates []core.WatchState
+	stop    chan struct{}
+}
+
+func (d *watchStateDriver) WatchAllState(baseKey string, sType core.State,
+	unmarshal func([]byte, interface{}) error, rsps chan core.WatchState) error {
+	for _, rsp := range d.updates {
+		select {
+		case rsps <- rsp:
+		case <-d.stop:
+			return nil
+		}
+	}
+	<-d.stop
+	return nil
+}
+
+func TestWatchGlobalCfg(t *testing.T) {
+	d := &watchStateDriver{stop: make(chan struct{})}
+	defer close(d.stop)
+	d.updates = []core.WatchState{
+		{Curr: &Cfg{Auto: AutoParams{VLANs: "1-10"}}},
+		{Curr: nil, Prev: &Cfg{Auto: AutoParams{VLANs: "1-10"}}},
+		{Curr: &Cfg{Auto: AutoParams{VLANs: "1-20"}}},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cfgs, err := WatchGlobalCfg(ctx, d)
+	if err != nil {
+		t.Fatalf("error watching global config - %s \n", err)
+	}
+
+	for _, vlans := range []string{"1-10", "1-20"} {
+		select {
+		case cfg := <-cfgs:
+			if cfg.Auto.VLANs != vlans {
+				t.Fatalf("error - expecting vlans %q but got %q \n", vlans, cfg.Auto.VLANs)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("error - timed out waiting for config %q \n", vlans)
+		}
+	}
+
+	cancel()
+	select {
+	case _, ok := <-cfgs:
+		if ok {
+			t.Fatalf("error - expecting channel to be closed after cancel")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("error - channel not closed after cancel")
+	}
+
+	if _, err := WatchGlobalCfg(context.Background(), nil); err == nil {
+		t.Fatalf("error - watch succeeded with a nil state driver")
+	}
+}
+
+// streamingStateDriver sends its updates to watchers with no way of being
+// stopped, like the etcd driver, and closes sent once all were delivered.
+type streamingStateDriver struct {
+	state.FakeStateDriver
+	updates []core.WatchState
+	sent    chan struct{}
+}
+
+func (d *streamingStateDriver) WatchAllState(baseKey string, sType core.State,
+	unmarshal func([]byte, interface{}) error, rsps chan core.WatchState) error {
+	for _, rsp := range d.updates {
+		rsps <- rsp
+	}
+	close(d.sent)
+	return nil
+}
+
+func TestWatchGlobalCfgDrains(t *testing.T) {
+	d := &streamingStateDriver{sent: make(chan struct{})}
+	for i := 0; i < 10; i++ {
+		d.updates = append(d.updates, core.WatchState{Curr: &Cfg{Auto: AutoParams{VLANs: "1-10"}}})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cfgs, err := WatchGlobalCfg(ctx, d)
+	if err != nil {
+		t.Fatalf("error watching global config - %s \n", err)
+	}
+	select {
+	case <-cfgs:
+	case <-time.After(time.Second):
+		t.Fatalf("error - timed out waiting for config")
+	}
+
+	cancel()
+	select {
+	case <-d.sent:
+	case <-time.After(time.Second):
+		t.Fatalf("error - watch blocked after cancel")
+	}
+}
+
+func TestQuota(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-10",
+                "VXLANs"            : "10000-10010"
+            },
+            "Quota" : {
+                "MaxVLANs"          : 2,
+                "MaxVXLANs"         : 1
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	for i := 0; i < 2; i++ {
+		if _, err := gc.AllocVLAN(uint(0)); err != nil {
+			t.Fatalf("error - allocating vlan - %s \n", err)
+		}
+	}
+	if _, err := gc.AllocVLAN(uint(0)); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("error - expecting ErrQuotaExceeded but got %v \n", err)
+	}
+
+	vxlan, localVLAN, err := gc.AllocVXLAN(uint(0))
+	if err != nil {
+		t.Fatalf("error - allocating vxlan - %s \n", err)
+	}
+	if _, _, err := gc.AllocVXLAN(uint(0)); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("error - expecting ErrQuotaExceeded but got %v \n", err)
+	}
+
+	// freeing brings the usage back under quota
+	if err := gc.FreeVXLAN(vxlan, localVLAN); err != nil {
+		t.Fatalf("error freeing vxlan - %s \n", err)
+	}
+	if _, _, err := gc.AllocVXLAN(uint(0)); err != nil {
+		t.Fatalf("error - allocating vxlan after free - %s \n", err)
+	}
+
+	// no quota means the whole pool can be used
+	gc.Quota = Quota{}
+	if _, err := gc.AllocVLAN(uint(0)); err != nil {
+		t.Fatalf("error - allocating vlan without quota - %s \n", err)
+	}
+}
+
+func TestQuotaIgnoresFreeBitsOutsidePool(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-10",
+                "VXLANs"            : "10000-10010"
+            },
+            "Quota" : {
+                "MaxVLANs"          : 5
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	// a free bit outside the pool must not underflow the in-use count
+	vlanOper, err := gc.readVLANOper()
+	if err != nil {
+		t.Fatalf("error reading vlan oper state - %s \n", err)
+	}
+	vlanOper.FreeVLANs.Set(100)
+	if err := vlanOper.Write(); err != nil {
+		t.Fatalf("error writing vlan oper state - %s \n", err)
+	}
+	if _, err := gc.AllocVLAN(uint(0)); err != nil {
+		t.Fatalf("error - allocating vlan - %s \n", err)
+	}
+}
+
+func TestVXLANBitsetSize(t *testing.T) {
+	gc := &Cfg{}
+	for _, tc := range []struct {
+		vxlans string
+		len    uint
+	}{
+		{"10000-10010", 12},
+		{"10000-26000", 16002},
+		{"101-400, 10000-15000", 14901},
+	} {
+		vxlanRsrcCfg, freeVXLANsStart, err := gc.initVXLANBitset(tc.vxlans)
+		if err != nil {
+			t.Fatalf("error initializing vxlan bitset for %q - %s \n", tc.vxlans, err)
+		}
+		if vxlanRsrcCfg.VXLANs.Len() != tc.len {
+			t.Fatalf("error - expecting bitset of %d bits for %q but got %d \n",
+				tc.len, tc.vxlans, vxlanRsrcCfg.VXLANs.Len())
+		}
+		if !vxlanRsrcCfg.VXLANs.Test(tc.len-1) || vxlanRsrcCfg.VXLANs.Test(0) {
+			t.Fatalf("error - unexpected bits set for %q (start %d) \n", tc.vxlans, freeVXLANsStart)
+		}
+	}
+}
+
+func TestTryAlloc(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-2",
+                "VXLANs"            : "10000-10001"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	for _, exp := range []uint{1, 2} {
+		vlan, ok := gc.TryAllocVLAN()
+		if !ok || vlan != exp {
+			t.Fatalf("error - expecting vlan %d but got %d (ok: %v) \n", exp, vlan, ok)
+		}
+	}
+	if vlan, ok := gc.TryAllocVLAN(); ok {
+		t.Fatalf("error - allocated vlan %d from an exhausted pool \n", vlan)
+	}
+
+	for _, exp := range []uint{10000, 10001} {
+		vxlan, _, ok := gc.TryAllocVXLAN()
+		if !ok || vxlan != exp {
+			t.Fatalf("error - expecting vxlan %d but got %d (ok: %v) \n", exp, vxlan, ok)
+		}
+	}
+	if vxlan, _, ok := gc.TryAllocVXLAN(); ok {
+		t.Fatalf("error - allocated vxlan %d from an exhausted pool \n", vxlan)
+	}
+}
+
+func TestOperVXLANRange(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-10",
+                "VXLANs"            : "101-200, 10000-10010"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	g := &Oper{}
+	g.StateDriver = gstateSD
+	if err := g.Read(""); err != nil {
+		t.Fatalf("error reading oper state - %s \n", err)
+	}
+	if g.VXLANRangeMin != 101 || g.VXLANRangeMax != 10010 {
+		t.Fatalf("error - expecting vxlan range 101-10010 but got %d-%d \n",
+			g.VXLANRangeMin, g.VXLANRangeMax)
+	}
+
+	for _, vxlan := range []uint{100, 10011, 20000} {
+		if _, _, err := gc.AllocVXLAN(vxlan); !errors.Is(err, ErrVXLANOutOfRange) {
+			t.Fatalf("error - expecting ErrVXLANOutOfRange allocating vxlan %d but got %v \n", vxlan, err)
+		}
+		if err := gc.FreeVXLAN(vxlan, 1); !errors.Is(err, ErrVXLANOutOfRange) {
+			t.Fatalf("error - expecting ErrVXLANOutOfRange freeing vxlan %d but got %v \n", vxlan, err)
+		}
+	}
+
+	if vxlan, _, err := gc.AllocVXLAN(10010); err != nil || vxlan != 10010 {
+		t.Fatalf("error - allocating vxlan 10010 - got %d (err: %v) \n", vxlan, err)
+	}
+}
+
+func TestBulkFree(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-10",
+                "VXLANs"            : "10000-10010"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	vlans := []uint{}
+	pairs := []VXLANLocalVLAN{}
+	for i := 0; i < 3; i++ {
+		vlan, err := gc.AllocVLAN(uint(0))
+		if err != nil {
+			t.Fatalf("error - allocating vlan - %s \n", err)
+		}
+		vlans = append(vlans, vlan)
+
+		vxlan, localVLAN, err := gc.AllocVXLAN(uint(0))
+		if err != nil {
+			t.Fatalf("error - allocating vxlan - %s \n", err)
+		}
+		pairs = append(pairs, VXLANLocalVLAN{VXLAN: vxlan, LocalVLAN: localVLAN})
+	}
+
+	// freeing twice is not an error
+	for i := 0; i < 2; i++ {
+		if err := gc.FreeVLANs(vlans); err != nil {
+			t.Fatalf("error freeing vlans %v - %s \n", vlans, err)
+		}
+		if err := gc.FreeVXLANs(pairs); err != nil {
+			t.Fatalf("error freeing vxlans %v - %s \n", pairs, err)
+		}
+	}
+
+	if free, err := gc.NumFreeVLANs(); err != nil || free != 10 {
+		t.Fatalf("error - expecting 10 free vlans but got %d (err: %v) \n", free, err)
+	}
+	if free, err := gc.NumFreeVXLANs(); err != nil || free != 11 {
+		t.Fatalf("error - expecting 11 free vxlans but got %d (err: %v) \n", free, err)
+	}
+
+	err := gc.FreeVXLANs([]VXLANLocalVLAN{{VXLAN: 10000, LocalVLAN: 1},
+		{VXLAN: 20000, LocalVLAN: 1}, {VXLAN: 30000, LocalVLAN: 1}})
+	if !errors.Is(err, ErrVXLANOutOfRange) ||
+		!strings.Contains(err.Error(), "20000") || !strings.Contains(err.Error(), "30000") {
+		t.Fatalf("error - expecting out of range errors for vxlans 20000 and 30000 but got %v \n", err)
+	}
+}
+
+func TestOperClone(t *testing.T) {
+	g := &Oper{DefaultNetwork: "orange", FreeVXLANsStart: 9999,
+		VXLANRangeMin: 10000, VXLANRangeMax: 10010,
+		VXLANLocalVLANs: map[uint]uint{10000: 1},
+		AllocatedAt:     map[string]time.Time{"vlan/1": time.Unix(0, 0)},
+		VLANLeases:      map[uint]time.Time{1: time.Unix(60, 0)}}
+	g.StateDriver = gstateSD
+
+	clone := g.Clone()
+	if !reflect.DeepEqual(clone, g) {
+		t.Fatalf("error - expecting clone %+v but got %+v \n", g, clone)
+	}
+
+	clone.DefaultNetwork = "blue"
+	clone.VXLANRangeMax = 20000
+	clone.VXLANLocalVLANs[10001] = 2
+	clone.AllocatedAt["vlan/2"] = time.Unix(0, 0)
+	clone.VLANLeases[2] = time.Unix(60, 0)
+	if g.DefaultNetwork != "orange" || g.VXLANRangeMax != 10010 || len(g.VXLANLocalVLANs) != 1 ||
+		len(g.AllocatedAt) != 1 || len(g.VLANLeases) != 1 {
+		t.Fatalf("error - modifying the clone changed the original %+v \n", g)
+	}
+}
+
+func TestLocalVLANRange(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-10",
+                "VXLANs"            : "10000-10010"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := gc.AllocVXLAN(uint(0)); err != nil {
+			t.Fatalf("error - allocating vxlan - %s \n", err)
+		}
+	}
+
+	g := &Oper{}
+	g.StateDriver = gstateSD
+	free, sample, err := g.LocalVLANRange()
+	if err != nil {
+		t.Fatalf("error getting local vlan range - %s \n", err)
+	}
+	if free != 4092 {
+		t.Fatalf("error - expecting 4092 free local vlans but got %d \n", free)
+	}
+	if len(sample) != localVLANSampleSize || sample[0] != 3 || sample[len(sample)-1] != 12 {
+		t.Fatalf("error - unexpected local vlan sample %v \n", sample)
+	}
+}
+
+func TestWriteIfUnchanged(t *testing.T) {
+	gstateSD.Init(nil)
+	defer func() { gstateSD.Deinit() }()
+
+	gc := &Cfg{Auto: AutoParams{VLANs: "1-10"}}
+	gc.StateDriver = gstateSD
+	if err := gc.WriteIfUnchanged(nil); err != nil {
+		t.Fatalf("error writing new config - %s \n", err)
+	}
+	if err := gc.WriteIfUnchanged(nil); !errors.Is(err, ErrConflict) {
+		t.Fatalf("error - expecting ErrConflict overwriting config but got %v \n", err)
+	}
+
+	// two controllers read the same config and both try to update it
+	prev := &Cfg{}
+	prev.StateDriver = gstateSD
+	if err := prev.Read(""); err != nil {
+		t.Fatalf("error reading config - %s \n", err)
+	}
+
+	first := &Cfg{Auto: AutoParams{VLANs: "1-20"}}
+	first.StateDriver = gstateSD
+	if err := first.WriteIfUnchanged(prev); err != nil {
+		t.Fatalf("error updating config - %s \n", err)
+	}
+
+	second := &Cfg{Auto: AutoParams{VLANs: "1-30"}}
+	second.StateDriver = gstateSD
+	if err := second.WriteIfUnchanged(prev); !errors.Is(err, ErrConflict) {
+		t.Fatalf("error - expecting ErrConflict for a stale update but got %v \n", err)
+	}
+
+	stored := &Cfg{}
+	stored.StateDriver = gstateSD
+	if err := stored.Read(""); err != nil {
+		t.Fatalf("error reading config - %s \n", err)
+	}
+	if stored.Auto.VLANs != "1-20" {
+		t.Fatalf("error - expecting vlans %q but got %q \n", "1-20", stored.Auto.VLANs)
+	}
+
+	// retrying on top of the latest config succeeds
+	if err := second.WriteIfUnchanged(stored); err != nil {
+		t.Fatalf("error updating config - %s \n", err)
+	}
+}
+
+func TestValidateConfigBounds(t *testing.T) {
+	for _, tc := range []struct {
+		cfg   Cfg
+		valid bool
+		field string
+	}{
+		{Cfg{Auto: AutoParams{VLANs: "1-4094"}}, true, ""},
+		{Cfg{Auto: AutoParams{VLANs: "0-10"}}, false, "0-10"},
+		{Cfg{Auto: AutoParams{VLANs: "1-4095"}}, false, "1-4095"},
+		{Cfg{Auto: AutoParams{VXLANs: "1-16000"}}, true, ""},
+		{Cfg{Auto: AutoParams{VXLANs: "0-100"}}, false, "0-100"},
+		{Cfg{Auto: AutoParams{VXLANs: "60000-65536"}}, false, "60000-65536"},
+		{Cfg{Quota: Quota{MaxVLANs: 4094, MaxVXLANs: 65535}}, true, ""},
+		{Cfg{Quota: Quota{MaxVLANs: 4095}}, false, "Quota.MaxVLANs"},
+		{Cfg{Quota: Quota{MaxVXLANs: 65536}}, false, "Quota.MaxVXLANs"},
+	} {
+		err := ValidateConfig(&tc.cfg)
+		if tc.valid && err != nil {
+			t.Fatalf("error validating config %+v - %s \n", tc.cfg, err)
+		}
+		if !tc.valid && (err == nil || !strings.Contains(err.Error(), tc.field)) {
+			t.Fatalf("error - expecting error mentioning %q for config %+v but got %v \n",
+				tc.field, tc.cfg, err)
+		}
+	}
+}
+
+func TestCheckErrorsReportsAll(t *testing.T) {
+	gc := &Cfg{Auto: AutoParams{VLANs: "1-10", ReservedVLANs: []uint{5000}}, Quota: Quota{MaxVLANs: 9999}}
+	err := gc.checkErrors("vlan")
+	if err == nil || !strings.Contains(err.Error(), "5000") || !strings.Contains(err.Error(), "MaxVLANs") {
+		t.Fatalf("error - expecting both reserved vlan and quota errors but got %v \n", err)
+	}
+
+	gc = &Cfg{Auto: AutoParams{VXLANs: "abc"}, Quota: Quota{MaxVXLANs: 99999}}
+	err = gc.checkErrors("vxlan")
+	if err == nil || !strings.Contains(err.Error(), "abc") || !strings.Contains(err.Error(), "MaxVXLANs") {
+		t.Fatalf("error - expecting both vxlan range and quota errors but got %v \n", err)
+	}
+}
+
+// base64Serializer stores the state as base64 encoded JSON.
+var base64Serializer = &Serializer{
+	Marshal: func(v interface{}) ([]byte, error) {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(base64.StdEncoding.EncodeToString(b)), nil
+	},
+	Unmarshal: func(data []byte, v interface{}) error {
+		b, err := base64.StdEncoding.DecodeString(string(data))
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(b, v)
+	},
+}
+
+func TestSerializer(t *testing.T) {
+	gstateSD.Init(nil)
+	defer func() { gstateSD.Deinit() }()
+
+	gc := &Cfg{Auto: AutoParams{VLANs: "1-10", VXLANs: "10000-10010"}, Serializer: base64Serializer}
+	gc.StateDriver = gstateSD
+	if err := gc.Write(); err != nil {
+		t.Fatalf("error writing config - %s \n", err)
+	}
+	g := &Oper{DefaultNetwork: "orange", FreeVXLANsStart: 9999, Serializer: base64Serializer}
+	g.StateDriver = gstateSD
+	if err := g.Write(); err != nil {
+		t.Fatalf("error writing oper state - %s \n", err)
+	}
+
+	raw, err := gstateSD.Read(CfgKey())
+	if err != nil {
+		t.Fatalf("error reading raw config - %s \n", err)
+	}
+	if json.Valid(raw) {
+		t.Fatalf("error - config stored as plain JSON %s \n", raw)
+	}
+
+	cfg := &Cfg{Serializer: base64Serializer}
+	cfg.StateDriver = gstateSD
+	if err := cfg.Read(""); err != nil {
+		t.Fatalf("error reading config - %s \n", err)
+	}
+	if !reflect.DeepEqual(cfg.Auto, gc.Auto) {
+		t.Fatalf("error - expecting config %+v but got %+v \n", gc.Auto, cfg.Auto)
+	}
+	oper := &Oper{Serializer: base64Serializer}
+	oper.StateDriver = gstateSD
+	if err := oper.Read(""); err != nil {
+		t.Fatalf("error reading oper state - %s \n", err)
+	}
+	if oper.DefaultNetwork != "orange" || oper.FreeVXLANsStart != 9999 {
+		t.Fatalf("error - unexpected oper state %+v \n", oper)
+	}
+
+	// the default JSON serializer can't read it back
+	cfg = &Cfg{}
+	cfg.StateDriver = gstateSD
+	if err := cfg.Read(""); err == nil {
+		t.Fatalf("error - read base64 encoded config as JSON")
+	}
+}
+
+func TestAllocVXLANLocalVLANExhausted(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-10",
+                "VXLANs"            : "10000-10010"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	oper, err := gc.readVXLANOper()
+	if err != nil {
+		t.Fatalf("error reading vxlan oper state - %s \n", err)
+	}
+	oper.FreeLocalVLANs.ClearAll()
+	oper.FreeLocalVLANs.Set(1)
+	if err := oper.Write(); err != nil {
+		t.Fatalf("error writing vxlan oper state - %s \n", err)
+	}
+
+	if _, _, err := gc.AllocVXLAN(uint(0)); err != nil {
+		t.Fatalf("error - allocating vxlan - %s \n", err)
+	}
+	_, _, err = gc.AllocVXLAN(uint(0))
+	if !errors.Is(err, ErrLocalVLANExhausted) {
+		t.Fatalf("error - expecting ErrLocalVLANExhausted but got %v \n", err)
+	}
+	if !strings.Contains(err.Error(), `vxlan pool "global" has 10 free`) {
+		t.Fatalf("error - expecting the pool and free count in %q \n", err)
+	}
+	if _, _, err := gc.AllocVXLAN(uint(10005)); !errors.Is(err, ErrLocalVLANExhausted) {
+		t.Fatalf("error - expecting ErrLocalVLANExhausted but got %v \n", err)
+	}
+
+	// the failed allocations must not consume any vxlan
+	if free, err := gc.NumFreeVXLANs(); err != nil || free != 10 {
+		t.Fatalf("error - expecting 10 free vxlans but got %d (err: %v) \n", free, err)
+	}
+	if err := gc.SetVXLAN(10005); err != nil {
+		t.Fatalf("error - vxlan 10005 leaked by the failed allocation - %s \n", err)
+	}
+}
+
+func TestAllocVLANHighest(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-10, 4090-4094",
+                "VXLANs"            : "10000-10010"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	for _, exp := range []uint{4094, 4093, 4092, 4091, 4090, 10} {
+		vlan, err := gc.AllocVLANHighest()
+		if err != nil || vlan != exp {
+			t.Fatalf("error - expecting vlan %d but got %d (err: %v) \n", exp, vlan, err)
+		}
+	}
+
+	// the lowest vlans are still handed out by AllocVLAN
+	if vlan, err := gc.AllocVLAN(uint(0)); err != nil || vlan != 1 {
+		t.Fatalf("error - expecting vlan 1 but got %d (err: %v) \n", vlan, err)
+	}
+
+	for i := 0; i < 8; i++ {
+		if _, err := gc.AllocVLANHighest(); err != nil {
+			t.Fatalf("error - allocating vlan - %s \n", err)
+		}
+	}
+	if _, err := gc.AllocVLANHighest(); !errors.Is(err, ErrVLANExhausted) {
+		t.Fatalf("error - expecting ErrVLANExhausted but got %v \n", err)
+	}
+}
+
+func TestCollectMetrics(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-10",
+                "VXLANs"            : "10000-10010"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	if _, err := gc.AllocVLAN(uint(0)); err != nil {
+		t.Fatalf("error - allocating vlan - %s \n", err)
+	}
+	if _, _, err := gc.AllocVXLAN(uint(0)); err != nil {
+		t.Fatalf("error - allocating vxlan - %s \n", err)
+	}
+
+	g := &Oper{}
+	g.StateDriver = gstateSD
+	values := map[string]float64{}
+	for _, m := range g.CollectMetrics() {
+		values[m.Name+"/"+m.Labels["pool"]] = m.Value
+	}
+
+	expValues := map[string]float64{
+		"netplugin_pool_free/vlan":       9,
+		"netplugin_pool_total/vlan":      10,
+		"netplugin_pool_free/localvlan":  4093,
+		"netplugin_pool_total/localvlan": 4094,
+		"netplugin_pool_free/vxlan":      10,
+		"netplugin_pool_total/vxlan":     11,
+	}
+	if len(values) != len(expValues) {
+		t.Fatalf("error - expecting metrics %v but got %v \n", expValues, values)
+	}
+	for name, exp := range expValues {
+		if values[name] != exp {
+			t.Fatalf("error - expecting %s to be %v but got %v \n", name, exp, values[name])
+		}
+	}
+}
+
+func TestFreeVXLANByVNI(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-10",
+                "VXLANs"            : "10000-10010"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	vxlans := []uint{}
+	for i := 0; i < 3; i++ {
+		vxlan, _, err := gc.AllocVXLAN(uint(0))
+		if err != nil {
+			t.Fatalf("error - allocating vxlan - %s \n", err)
+		}
+		vxlans = append(vxlans, vxlan)
+	}
+
+	g := &Oper{}
+	g.StateDriver = gstateSD
+	if err := g.Read(""); err != nil {
+		t.Fatalf("error reading oper state - %s \n", err)
+	}
+	if !reflect.DeepEqual(g.VXLANLocalVLANs, map[uint]uint{10000: 1, 10001: 2, 10002: 3}) {
+		t.Fatalf("error - unexpected vxlan to local vlan map %v \n", g.VXLANLocalVLANs)
+	}
+
+	// a mismatched local vlan must not free another network's local vlan
+	if err := gc.FreeVXLAN(vxlans[1], 3); err == nil {
+		t.Fatalf("error - freed vxlan %d with local vlan 3 \n", vxlans[1])
+	}
+	if err := gc.FreeVXLANByVNI(vxlans[1]); err != nil {
+		t.Fatalf("error freeing vxlan %d - %s \n", vxlans[1], err)
+	}
+	if err := gc.FreeVXLANByVNI(vxlans[1]); err == nil {
+		t.Fatalf("error - freed vxlan %d twice by vni \n", vxlans[1])
+	}
+
+	// both the vxlan and its local vlan are handed out again
+	vxlan, localVLAN, err := gc.AllocVXLAN(uint(0))
+	if err != nil || vxlan != 10001 || localVLAN != 2 {
+		t.Fatalf("error - expecting vxlan 10001 local vlan 2 but got %d, %d (err: %v) \n",
+			vxlan, localVLAN, err)
+	}
+
+	// the two argument form keeps the map in sync
+	if err := gc.FreeVXLAN(vxlans[0], 1); err != nil {
+		t.Fatalf("error freeing vxlan %d - %s \n", vxlans[0], err)
+	}
+	g = &Oper{}
+	g.StateDriver = gstateSD
+	if err := g.Read(""); err != nil {
+		t.Fatalf("error reading oper state - %s \n", err)
+	}
+	if !reflect.DeepEqual(g.VXLANLocalVLANs, map[uint]uint{10001: 2, 10002: 3}) {
+		t.Fatalf("error - unexpected vxlan to local vlan map %v \n", g.VXLANLocalVLANs)
+	}
+}
+
+func TestSelfCheck(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-10",
+                "VXLANs"            : "10000-10010"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	if _, _, err := gc.AllocVXLAN(uint(0)); err != nil {
+		t.Fatalf("error - allocating vxlan - %s \n", err)
+	}
+	if err := gc.SetVXLAN(10005); err != nil {
+		t.Fatalf("error reserving vxlan - %s \n", err)
+	}
+
+	g := &Oper{}
+	g.StateDriver = gstateSD
+	if err := g.Read(""); err != nil {
+		t.Fatalf("error reading oper state - %s \n", err)
+	}
+	if problems := g.SelfCheck(); len(problems) != 0 {
+		t.Fatalf("error - unexpected inconsistencies %v \n", problems)
+	}
+
+	// corrupt the free pools behind the allocator's back
+	vlanOper, err := gc.readVLANOper()
+	if err != nil {
+		t.Fatalf("error reading vlan oper state - %s \n", err)
+	}
+	vlanOper.FreeVLANs.Set(20)
+	if err := vlanOper.Write(); err != nil {
+		t.Fatalf("error writing vlan oper state - %s \n", err)
+	}
+	vxlanOper, err := gc.readVXLANOper()
+	if err != nil {
+		t.Fatalf("error reading vxlan oper state - %s \n", err)
+	}
+	vxlanOper.FreeLocalVLANs.Set(1)
+	vxlanOper.FreeVXLANs.Clear(10003 - g.FreeVXLANsStart)
+	if err := vxlanOper.Write(); err != nil {
+		t.Fatalf("error writing vxlan oper state - %s \n", err)
+	}
+
+	problems := g.SelfCheck()
+	expProblems := []string{
+		"1 free vlans are outside the vlan pool",
+		"allocated vxlan 10003 has no local vlan recorded",
+		"local vlan 1 of vxlan 10000 is not allocated",
+	}
+	if !reflect.DeepEqual(problems, expProblems) {
+		t.Fatalf("error - expecting inconsistencies %v but got %v \n", expProblems, problems)
+	}
+}
+
+func TestAllocVLANExcluding(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-10",
+                "VXLANs"            : "10000-10010"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	exclude := []uint{1, 2, 3, 4, 5, 6, 7, 8, 9}
+	vlan, err := gc.AllocVLANExcluding(exclude)
+	if err != nil || vlan != 10 {
+		t.Fatalf("error - expecting vlan 10 but got %d (err: %v) \n", vlan, err)
+	}
+
+	if _, err := gc.AllocVLANExcluding(exclude); !errors.Is(err, ErrVLANExhausted) {
+		t.Fatalf("error - expecting ErrVLANExhausted but got %v \n", err)
+	}
+
+	// the excluded vlans are still free
+	if vlan, err := gc.AllocVLAN(uint(0)); err != nil || vlan != 1 {
+		t.Fatalf("error - expecting vlan 1 but got %d (err: %v) \n", vlan, err)
+	}
+}
+
+func TestOldestAllocation(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-10",
+                "VXLANs"            : "10000-10010"
+            },
+            "TrackAllocationTime"   : true
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	start := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	for i := 0; i < 3; i++ {
+		if _, err := gc.AllocVLAN(uint(0)); err != nil {
+			t.Fatalf("error - allocating vlan - %s \n", err)
+		}
+		if _, _, err := gc.AllocVXLAN(uint(0)); err != nil {
+			t.Fatalf("error - allocating vxlan - %s \n", err)
+		}
+		now = now.Add(time.Minute)
+	}
+	if err := gc.FreeVLAN(1); err != nil {
+		t.Fatalf("error freeing vlan - %s \n", err)
+	}
+	if err := gc.FreeVXLAN(10000, 1); err != nil {
+		t.Fatalf("error freeing vxlan - %s \n", err)
+	}
+
+	g := &Oper{}
+	g.StateDriver = gstateSD
+	if err := g.Read(""); err != nil {
+		t.Fatalf("error reading oper state - %s \n", err)
+	}
+	if id, age := g.OldestAllocation("vlan"); id != "2" || age != 2*time.Minute {
+		t.Fatalf("error - expecting vlan 2 held for 2m but got %q for %s \n", id, age)
+	}
+	if id, age := g.OldestAllocation("vxlan"); id != "10001" || age != 2*time.Minute {
+		t.Fatalf("error - expecting vxlan 10001 held for 2m but got %q for %s \n", id, age)
+	}
+
+	// redefining the vxlan resource keeps the vlan allocation times
+	if err := gc.DeleteResources("vxlan"); err != nil {
+		t.Fatalf("error deleting vxlan resource - %s \n", err)
+	}
+	if err := gc.Process("vxlan"); err != nil {
+		t.Fatalf("error processing config - %s \n", err)
+	}
+	g = &Oper{}
+	g.StateDriver = gstateSD
+	if err := g.Read(""); err != nil {
+		t.Fatalf("error reading oper state - %s \n", err)
+	}
+	if id, age := g.OldestAllocation("vlan"); id != "2" || age != 2*time.Minute {
+		t.Fatalf("error - expecting vlan 2 held for 2m but got %q for %s \n", id, age)
+	}
+	if id, _ := g.OldestAllocation("vxlan"); id != "" {
+		t.Fatalf("error - unexpected allocation time kept for vxlan %s \n", id)
+	}
+
+	// nothing is recorded unless the config opts in
+	gc.TrackAllocationTime = false
+	if err := gc.ReleaseAll(); err != nil {
+		t.Fatalf("error releasing all allocations - %s \n", err)
+	}
+	if _, err := gc.AllocVLAN(uint(0)); err != nil {
+		t.Fatalf("error - allocating vlan - %s \n", err)
+	}
+	g = &Oper{}
+	g.StateDriver = gstateSD
+	if err := g.Read(""); err != nil {
+		t.Fatalf("error reading oper state - %s \n", err)
+	}
+	if id, _ := g.OldestAllocation("vlan"); id != "" {
+		t.Fatalf("error - unexpected allocation time recorded for vlan %s \n", id)
+	}
+}
+
+func TestAllocNetworkTag(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-10",
+                "VXLANs"            : "10000-10010"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	for _, tc := range []struct {
+		encap     string
+		reqTag    uint
+		tag       uint
+		localVLAN uint
+		isVXLAN   bool
+	}{
+		{"vlan", 0, 1, 0, false},
+		{"vlan", 5, 5, 0, false},
+		{"vxlan", 0, 10000, 1, true},
+		{"vxlan", 10005, 10005, 2, true},
+		{"", 0, 0, 0, false},
+	} {
+		tag, localVLAN, isVXLAN, err := gc.AllocNetworkTag(tc.encap, tc.reqTag)
+		if err != nil {
+			t.Fatalf("error allocating %q tag %d - %s \n", tc.encap, tc.reqTag, err)
+		}
+		if tag != tc.tag || localVLAN != tc.localVLAN || isVXLAN != tc.isVXLAN {
+			t.Fatalf("error - expecting %q tag %d/%d/%v but got %d/%d/%v \n", tc.encap,
+				tc.tag, tc.localVLAN, tc.isVXLAN, tag, localVLAN, isVXLAN)
+		}
+	}
+
+	if _, _, _, err := gc.AllocNetworkTag("vlan", 5); !errors.Is(err, ErrVLANUnavailable) {
+		t.Fatalf("error - expecting ErrVLANUnavailable but got %v \n", err)
+	}
+	if _, _, _, err := gc.AllocNetworkTag("gre", 0); err == nil {
+		t.Fatalf("error - allocated a tag for an invalid encap")
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-10",
+                "VXLANs"            : "10000-10010"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	for i := 0; i < 3; i++ {
+		if _, err := gc.AllocVLAN(uint(0)); err != nil {
+			t.Fatalf("error - allocating vlan - %s \n", err)
+		}
+	}
+	vxlan, localVLAN, err := gc.AllocVXLAN(uint(10005))
+	if err != nil {
+		t.Fatalf("error - allocating vxlan - %s \n", err)
+	}
+
+	// shrinking below allocated vlans is rejected
+	newCfg := &Cfg{Auto: AutoParams{VLANs: "3-20", VXLANs: gc.Auto.VXLANs}}
+	newCfg.StateDriver = gstateSD
+	if err := newCfg.ApplyConfig("vlan"); err == nil {
+		t.Fatalf("error - applied a config orphaning vlans 1 and 2")
+	}
+	if free, err := gc.NumFreeVLANs(); err != nil || free != 7 {
+		t.Fatalf("error - expecting 7 free vlans but got %d (err: %v) \n", free, err)
+	}
+
+	// growing keeps the allocations
+	newCfg.Auto = AutoParams{VLANs: "1-20", VXLANs: "9990-10020"}
+	for _, res := range []string{"vlan", "vxlan"} {
+		if err := newCfg.ApplyConfig(res); err != nil {
+			t.Fatalf("error applying %s config - %s \n", res, err)
+		}
+	}
+	if free, err := newCfg.NumFreeVLANs(); err != nil || free != 17 {
+		t.Fatalf("error - expecting 17 free vlans but got %d (err: %v) \n", free, err)
+	}
+	if vlan, err := newCfg.AllocVLAN(uint(0)); err != nil || vlan != 4 {
+		t.Fatalf("error - expecting vlan 4 but got %d (err: %v) \n", vlan, err)
+	}
+	if free, err := newCfg.NumFreeVXLANs(); err != nil || free != 30 {
+		t.Fatalf("error - expecting 30 free vxlans but got %d (err: %v) \n", free, err)
+	}
+	if _, _, err := newCfg.AllocVXLAN(vxlan); !errors.Is(err, ErrVXLANUnavailable) {
+		t.Fatalf("error - expecting vxlan %d to remain allocated but got %v \n", vxlan, err)
+	}
+	if vxlan, newLocalVLAN, err := newCfg.AllocVXLAN(uint(0)); err != nil ||
+		vxlan != 9990 || newLocalVLAN == localVLAN {
+		t.Fatalf("error - expecting vxlan 9990 with a new local vlan but got %d, %d (err: %v) \n",
+			vxlan, newLocalVLAN, err)
+	}
+	if err := newCfg.FreeVXLANByVNI(vxlan); err != nil {
+		t.Fatalf("error freeing vxlan %d - %s \n", vxlan, err)
+	}
+}
+
+func TestNilStateDriver(t *testing.T) {
+	gc := &Cfg{Auto: AutoParams{VLANs: "1-10"}}
+	if err := gc.Process("vlan"); !errors.Is(err, ErrNilStateDriver) {
+		t.Fatalf("error - expecting ErrNilStateDriver from Process but got %v \n", err)
+	}
+	if err := gc.Write(); !errors.Is(err, ErrNilStateDriver) {
+		t.Fatalf("error - expecting ErrNilStateDriver from Write but got %v \n", err)
+	}
+	if err := gc.Read(""); !errors.Is(err, ErrNilStateDriver) {
+		t.Fatalf("error - expecting ErrNilStateDriver from Read but got %v \n", err)
+	}
+
+	g := &Oper{}
+	if err := g.Write(); !errors.Is(err, ErrNilStateDriver) {
+		t.Fatalf("error - expecting ErrNilStateDriver from Oper Write but got %v \n", err)
+	}
+	if err := g.Read(""); !errors.Is(err, ErrNilStateDriver) {
+		t.Fatalf("error - expecting ErrNilStateDriver from Oper Read but got %v \n", err)
+	}
+	if _, err := gc.ReadAll(); !errors.Is(err, ErrNilStateDriver) {
+		t.Fatalf("error - expecting ErrNilStateDriver from ReadAll but got %v \n", err)
+	}
+	if err := gc.Clear(); !errors.Is(err, ErrNilStateDriver) {
+		t.Fatalf("error - expecting ErrNilStateDriver from Clear but got %v \n", err)
+	}
+	if _, err := g.ReadAll(); !errors.Is(err, ErrNilStateDriver) {
+		t.Fatalf("error - expecting ErrNilStateDriver from Oper ReadAll but got %v \n", err)
+	}
+	if err := g.Clear(); !errors.Is(err, ErrNilStateDriver) {
+		t.Fatalf("error - expecting ErrNilStateDriver from Oper Clear but got %v \n", err)
+	}
+	if err := DeleteGlobalState(nil); !errors.Is(err, ErrNilStateDriver) {
+		t.Fatalf("error - expecting ErrNilStateDriver from DeleteGlobalState but got %v \n", err)
+	}
+	if _, err := ReadAllOper(nil); !errors.Is(err, ErrNilStateDriver) {
+		t.Fatalf("error - expecting ErrNilStateDriver from ReadAllOper but got %v \n", err)
+	}
+
+	gstateSD.Init(nil)
+	defer gstateSD.Deinit()
+	if _, err := resources.NewStateResourceManager(gstateSD); err != nil {
+		t.Fatalf("Failed to instantiate resource manager. Error: %s", err)
+	}
+	defer resources.ReleaseStateResourceManager()
+	if err := gc.FreeVXLAN(10000, 1); !errors.Is(err, ErrNilStateDriver) {
+		t.Fatalf("error - expecting ErrNilStateDriver from FreeVXLAN but got %v \n", err)
+	}
+}
+
+func TestTxn(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-10",
+                "VXLANs"            : "10000-10010"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	txn := gc.Begin()
+	if _, err := txn.AllocVLAN(uint(0)); err != nil {
+		t.Fatalf("error - allocating vlan - %s \n", err)
+	}
+	if _, _, err := txn.AllocVXLAN(uint(0)); err != nil {
+		t.Fatalf("error - allocating vxlan - %s \n", err)
+	}
+	// a later step fails, so the operation is undone
+	if _, err := txn.AllocVLAN(uint(100)); err == nil {
+		t.Fatalf("error - allocated vlan outside the configured range")
+	}
+	if err := txn.Rollback(); err != nil {
+		t.Fatalf("error rolling back - %s \n", err)
+	}
+
+	g := &Oper{}
+	g.StateDriver = gstateSD
+	if err := g.Read(""); err != nil {
+		t.Fatalf("error reading oper state - %s \n", err)
+	}
+	if problems := g.SelfCheck(); len(problems) != 0 {
+		t.Fatalf("error - unexpected inconsistencies %v \n", problems)
+	}
+	if free, err := gc.NumFreeVLANs(); err != nil || free != 10 {
+		t.Fatalf("error - expecting 10 free vlans but got %d (err: %v) \n", free, err)
+	}
+	if free, err := gc.NumFreeVXLANs(); err != nil || free != 11 {
+		t.Fatalf("error - expecting 11 free vxlans but got %d (err: %v) \n", free, err)
+	}
+
+	// committed allocations are kept
+	txn = gc.Begin()
+	vlan, err := txn.AllocVLAN(uint(0))
+	if err != nil {
+		t.Fatalf("error - allocating vlan - %s \n", err)
+	}
+	txn.Commit()
+	if err := txn.Rollback(); err != nil {
+		t.Fatalf("error rolling back a committed transaction - %s \n", err)
+	}
+	if _, err := gc.AllocVLAN(vlan); !errors.Is(err, ErrVLANUnavailable) {
+		t.Fatalf("error - expecting vlan %d to remain allocated but got %v \n", vlan, err)
+	}
+}
+
+func TestReadAllGlobalCfgLenient(t *testing.T) {
+	gstateSD.Init(nil)
+	defer func() { gstateSD.Deinit() }()
+
+	gc := &Cfg{Auto: AutoParams{VLANs: "1-10"}}
+	gc.StateDriver = gstateSD
+	if err := gc.Write(); err != nil {
+		t.Fatalf("error writing config - %s \n", err)
+	}
+	if err := gstateSD.Write(cfgGlobalPrefix+"broken", []byte("{not json")); err != nil {
+		t.Fatalf("error writing broken config - %s \n", err)
+	}
+
+	cfgs, errs := ReadAllGlobalCfgLenient(gstateSD, nil)
+	if len(cfgs) != 1 || !reflect.DeepEqual(cfgs[0].Auto, gc.Auto) || cfgs[0].StateDriver != gstateSD {
+		t.Fatalf("error - expecting config %+v but got %+v \n", gc, cfgs)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("error - expecting an error for the broken config but got %v \n", errs)
+	}
+
+	if _, errs := ReadAllGlobalCfgLenient(nil, nil); len(errs) != 1 || !errors.Is(errs[0], ErrNilStateDriver) {
+		t.Fatalf("error - expecting ErrNilStateDriver but got %v \n", errs)
+	}
+
+	// configs stored with another serializer are read with it
+	gc.Serializer = base64Serializer
+	if err := gc.Write(); err != nil {
+		t.Fatalf("error writing config - %s \n", err)
+	}
+	cfgs, errs = ReadAllGlobalCfgLenient(gstateSD, base64Serializer)
+	if len(cfgs) != 1 || !reflect.DeepEqual(cfgs[0].Auto, gc.Auto) || cfgs[0].Serializer != base64Serializer {
+		t.Fatalf("error - expecting config %+v but got %+v \n", gc, cfgs)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("error - expecting an error for the broken config but got %v \n", errs)
+	}
+}
+
+func TestStateKeys(t *testing.T) {
+	gstateSD.Init(nil)
+	defer func() { gstateSD.Deinit() }()
+
+	if CfgKey() != mastercfg.StateBasePath+"state/global/global" ||
+		OperKey() != mastercfg.StateBasePath+"oper/global/global" {
+		t.Fatalf("error - unexpected keys %q and %q \n", CfgKey(), OperKey())
+	}
+
+	gc := &Cfg{Auto: AutoParams{VLANs: "1-10"}}
+	gc.StateDriver = gstateSD
+	if err := gc.Write(); err != nil {
+		t.Fatalf("error writing config - %s \n", err)
+	}
+	g := &Oper{DefaultNetwork: "orange"}
+	g.StateDriver = gstateSD
+	if err := g.Write(); err != nil {
+		t.Fatalf("error writing oper state - %s \n", err)
+	}
+
+	for _, key := range []string{CfgKey(), OperKey()} {
+		if _, err := gstateSD.Read(key); err != nil {
+			t.Fatalf("error reading %s - %s \n", key, err)
+		}
+	}
+}
+
+func TestVLANBounds(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-4094",
+                "VXLANs"            : "10000-10010"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	for _, vlan := range []uint{4095, 4096, 100000} {
+		if _, err := gc.AllocVLAN(vlan); !errors.Is(err, ErrVLANUnavailable) {
+			t.Fatalf("error - expecting ErrVLANUnavailable allocating vlan %d but got %v \n", vlan, err)
+		}
+	}
+	for _, vlan := range []uint{0, 4095, 4096, 100000} {
+		if err := gc.FreeVLAN(vlan); err == nil {
+			t.Fatalf("error - freed out of range vlan %d \n", vlan)
+		}
+		if err := gc.FreeVXLAN(10000, vlan); err == nil {
+			t.Fatalf("error - freed out of range local vlan %d \n", vlan)
+		}
+	}
+
+	if vlan, err := gc.AllocVLAN(4094); err != nil || vlan != 4094 {
+		t.Fatalf("error - expecting vlan 4094 but got %d (err: %v) \n", vlan, err)
+	}
+	if err := gc.FreeVLAN(4094); err != nil {
+		t.Fatalf("error freeing vlan 4094 - %s \n", err)
+	}
+
+	// the pools are not grown or corrupted by the rejected calls
+	vlanOper, err := gc.readVLANOper()
+	if err != nil {
+		t.Fatalf("error reading vlan oper state - %s \n", err)
+	}
+	if vlanOper.FreeVLANs.Count() != 4094 || vlanOper.FreeVLANs.Len() != 4096 {
+		t.Fatalf("error - unexpected vlan pool of %d/%d bits \n",
+			vlanOper.FreeVLANs.Count(), vlanOper.FreeVLANs.Len())
+	}
+}
+
+func TestFreeVLANOutsidePool(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-2",
+                "VXLANs"            : "10000-10010"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	if err := gc.FreeVLAN(100); err == nil {
+		t.Fatalf("error - freed vlan 100 outside the pool \n")
+	}
+	for {
+		vlan, err := gc.AllocVLAN(uint(0))
+		if errors.Is(err, ErrVLANExhausted) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("error - allocating vlan - %s \n", err)
+		}
+		if vlan == 100 {
+			t.Fatalf("error - allocated vlan 100 outside the pool \n")
+		}
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-10",
+                "VXLANs"            : "10000-10010"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	vlan, err := gc.AllocVLAN(uint(0))
+	if err != nil {
+		t.Fatalf("error - allocating vlan - %s \n", err)
+	}
+	vxlan, _, err := gc.AllocVXLAN(uint(0))
+	if err != nil {
+		t.Fatalf("error - allocating vxlan - %s \n", err)
+	}
+	if err := gc.Write(); err != nil {
+		t.Fatalf("error writing config - %s \n", err)
+	}
+
+	data, err := Export(gstateSD)
+	if err != nil {
+		t.Fatalf("error exporting state - %s \n", err)
+	}
+
+	// restore into an empty store, twice
+	gstateSD.Init(nil)
+	for i := 0; i < 2; i++ {
+		if err := Import(gstateSD, data); err != nil {
+			t.Fatalf("error importing state - %s \n", err)
+		}
+	}
+
+	cfg := &Cfg{}
+	cfg.StateDriver = gstateSD
+	if err := cfg.Read(""); err != nil {
+		t.Fatalf("error reading imported config - %s \n", err)
+	}
+	if !reflect.DeepEqual(cfg.Auto, gc.Auto) {
+		t.Fatalf("error - expecting config %+v but got %+v \n", gc.Auto, cfg.Auto)
+	}
+	if _, err := cfg.AllocVLAN(vlan); !errors.Is(err, ErrVLANUnavailable) {
+		t.Fatalf("error - expecting vlan %d to remain allocated but got %v \n", vlan, err)
+	}
+	if err := cfg.FreeVXLANByVNI(vxlan); err != nil {
+		t.Fatalf("error freeing imported vxlan %d - %s \n", vxlan, err)
+	}
+	if free, err := cfg.NumFreeVXLANs(); err != nil || free != 11 {
+		t.Fatalf("error - expecting 11 free vxlans but got %d (err: %v) \n", free, err)
+	}
+
+	if err := Import(gstateSD, []byte(`{"version": 2}`)); err == nil {
+		t.Fatalf("error - imported an unsupported backup version")
+	}
+}
+
+func TestTagRanges(t *testing.T) {
+	gc := &Cfg{Auto: AutoParams{VLANs: "1-10, 20-30", VXLANs: "10000-10010"}}
+
+	for i := 0; i < 2; i++ {
+		vlanRanges, err := gc.VLANRanges()
+		if err != nil {
+			t.Fatalf("error getting vlan ranges - %s \n", err)
+		}
+		if len(vlanRanges) != 2 || vlanRanges[0].Min != 1 || vlanRanges[1].Max != 30 {
+			t.Fatalf("error - unexpected vlan ranges %+v \n", vlanRanges)
+		}
+		// callers can't modify the cached ranges
+		vlanRanges[0].Min = 5
+	}
+
+	vxlanRanges, err := gc.VXLANRanges()
+	if err != nil || len(vxlanRanges) != 1 || vxlanRanges[0].Min != 10000 {
+		t.Fatalf("error - unexpected vxlan ranges %+v (err: %v) \n", vxlanRanges, err)
+	}
+
+	// a changed config is parsed again
+	gc.Auto.VLANs = "100-200"
+	if vlanRanges, err := gc.VLANRanges(); err != nil || vlanRanges[0].Min != 100 {
+		t.Fatalf("error - unexpected vlan ranges %+v (err: %v) \n", vlanRanges, err)
+	}
+	gc.Auto.VLANs = "200-100"
+	if _, err := gc.VLANRanges(); err == nil {
+		t.Fatalf("error - invalid vlan range parsed")
+	}
+
+	// an empty config has no ranges
+	gc.Auto = AutoParams{}
+	if vlanRanges, err := gc.VLANRanges(); err != nil || vlanRanges == nil || len(vlanRanges) != 0 {
+		t.Fatalf("error - expecting no vlan ranges but got %+v (err: %v) \n", vlanRanges, err)
+	}
+	if vxlanRanges, err := gc.VXLANRanges(); err != nil || vxlanRanges == nil || len(vxlanRanges) != 0 {
+		t.Fatalf("error - expecting no vxlan ranges but got %+v (err: %v) \n", vxlanRanges, err)
+	}
+}
+
+func TestAllocVLANSpread(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-4094",
+                "VXLANs"            : "10000-10010"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	for _, exp := range []uint{2048, 1024, 3072, 512, 2560, 1536, 3584} {
+		vlan, err := gc.AllocVLANSpread()
+		if err != nil || vlan != exp {
+			t.Fatalf("error - expecting vlan %d but got %d (err: %v) \n", exp, vlan, err)
+		}
+	}
+
+	// allocated vlans are skipped
+	if _, err := gc.AllocVLAN(256); err != nil {
+		t.Fatalf("error - allocating vlan 256 - %s \n", err)
+	}
+	if vlan, err := gc.AllocVLANSpread(); err != nil || vlan != 2304 {
+		t.Fatalf("error - expecting vlan 2304 but got %d (err: %v) \n", vlan, err)
+	}
+
+	for {
+		if _, err := gc.AllocVLANSpread(); err != nil {
+			if !errors.Is(err, ErrVLANExhausted) {
+				t.Fatalf("error - expecting ErrVLANExhausted but got %v \n", err)
+			}
+			break
+		}
+	}
+	if free, err := gc.NumFreeVLANs(); err != nil || free != 0 {
+		t.Fatalf("error - expecting no free vlans but got %d (err: %v) \n", free, err)
+	}
+}
+
+func TestStateOperations(t *testing.T) {
+	gstateSD.Init(nil)
+	defer func() { gstateSD.Deinit() }()
+
+	gc := &Cfg{Auto: AutoParams{VLANs: "1-10", VXLANs: "10000-10010"}}
+	gc.StateDriver = gstateSD
+	g := &Oper{DefaultNetwork: "orange", FreeVXLANsStart: 9999}
+	g.StateDriver = gstateSD
+
+	for _, tc := range []struct {
+		name  string
+		state core.State
+		read  func() (core.State, error)
+	}{
+		{"cfg", gc, func() (core.State, error) {
+			cfg := &Cfg{}
+			cfg.StateDriver = gstateSD
+			return cfg, cfg.Read("")
+		}},
+		{"oper", g, func() (core.State, error) {
+			oper := &Oper{}
+			oper.StateDriver = gstateSD
+			return oper, oper.Read("")
+		}},
+	} {
+		if err := tc.state.Write(); err != nil {
+			t.Fatalf("%s: error writing state - %s \n", tc.name, err)
+		}
+
+		read, err := tc.read()
+		if err != nil {
+			t.Fatalf("%s: error reading state - %s \n", tc.name, err)
+		}
+		if !reflect.DeepEqual(read, tc.state) {
+			t.Fatalf("%s: expecting state %+v but got %+v \n", tc.name, tc.state, read)
+		}
+
+		all, err := tc.state.ReadAll()
+		if err != nil || len(all) != 1 || !reflect.DeepEqual(all[0], tc.state) {
+			t.Fatalf("%s: expecting a single state %+v but got %+v (err: %v) \n",
+				tc.name, tc.state, all, err)
+		}
+
+		if err := tc.state.Clear(); err != nil {
+			t.Fatalf("%s: error clearing state - %s \n", tc.name, err)
+		}
+		if _, err := tc.read(); err == nil {
+			t.Fatalf("%s: state read after it was cleared \n", tc.name)
+		}
+		if all, err := tc.state.ReadAll(); err == nil && len(all) != 0 {
+			t.Fatalf("%s: state listed after it was cleared %+v \n", tc.name, all)
+		}
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-10",
+                "VXLANs"            : "10000-10010"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	err := gc.Reconcile([]uint{3, 5}, []VXLANLocalVLAN{{VXLAN: 10004, LocalVLAN: 7},
+		{VXLAN: 10006}})
+	if err != nil {
+		t.Fatalf("error reconciling allocations - %s \n", err)
+	}
+
+	for _, vlan := range []uint{3, 5} {
+		if _, err := gc.AllocVLAN(vlan); !errors.Is(err, ErrVLANUnavailable) {
+			t.Fatalf("error - expecting vlan %d to be allocated but got %v \n", vlan, err)
+		}
+	}
+	if vlan, err := gc.AllocVLAN(uint(0)); err != nil || vlan != 1 {
+		t.Fatalf("error - expecting vlan 1 but got %d (err: %v) \n", vlan, err)
+	}
+	if err := gc.FreeVXLANByVNI(10004); err != nil {
+		t.Fatalf("error freeing reconciled vxlan 10004 - %s \n", err)
+	}
+
+	// every entry is attempted and all the problems are reported
+	err = gc.Reconcile([]uint{5, 8, 0, 20}, []VXLANLocalVLAN{{VXLAN: 10006}, {VXLAN: 20000}})
+	if !errors.Is(err, ErrVLANUnavailable) || !errors.Is(err, ErrVXLANUnavailable) ||
+		!errors.Is(err, ErrVXLANOutOfRange) {
+		t.Fatalf("error - expecting unavailable and out of range errors but got %v \n", err)
+	}
+	for _, s := range []string{"vlan 5", "vlan 0", "vlan 20", "vxlan 10006", "vxlan 20000"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Fatalf("error - expecting %q to be reported in %v \n", s, err)
+		}
+	}
+	if _, err := gc.AllocVLAN(8); !errors.Is(err, ErrVLANUnavailable) {
+		t.Fatalf("error - expecting vlan 8 to be allocated but got %v \n", err)
+	}
+}
+
+// testLogger records the debug logs.
+type testLogger struct {
+	mutex sync.Mutex
+	debug []string
+}
+
+func (l *testLogger) Debugf(format string, args ...interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.debug = append(l.debug, fmt.Sprintf(format, args...))
+}
+
+func (l *testLogger) Infof(format string, args ...interface{}) {}
+
+func (l *testLogger) Errorf(format string, args ...interface{}) {}
+
+func TestSetLogger(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-10",
+                "VXLANs"            : "10000-10010"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	l := &testLogger{}
+	SetLogger(l)
+	defer SetLogger(nil)
+
+	vlan, err := gc.AllocVLAN(uint(0))
+	if err != nil {
+		t.Fatalf("error - allocating vlan - %s \n", err)
+	}
+	if err := gc.FreeVLAN(vlan); err != nil {
+		t.Fatalf("error freeing vlan - %s \n", err)
+	}
+	vxlan, localVLAN, err := gc.AllocVXLAN(uint(0))
+	if err != nil {
+		t.Fatalf("error - allocating vxlan - %s \n", err)
+	}
+	if err := gc.FreeVXLAN(vxlan, localVLAN); err != nil {
+		t.Fatalf("error freeing vxlan - %s \n", err)
+	}
+
+	expLogs := []string{"alloc vlan 1", "free vlan 1",
+		"alloc vxlan 10000 local vlan 1", "free vxlan 10000 local vlan 1"}
+	if !reflect.DeepEqual(l.debug, expLogs) {
+		t.Fatalf("error - expecting logs %q but got %q \n", expLogs, l.debug)
+	}
+}
+
+func TestAllocVXLANWithLocalVLAN(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-10",
+                "VXLANs"            : "10000-10010"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	vxlan, err := gc.AllocVXLANWithLocalVLAN(100)
+	if err != nil || vxlan != 10000 {
+		t.Fatalf("error - expecting vxlan 10000 but got %d (err: %v) \n", vxlan, err)
+	}
+
+	// the local vlan is taken, so no vxlan is consumed
+	if _, err := gc.AllocVXLANWithLocalVLAN(100); !errors.Is(err, ErrLocalVLANUnavailable) {
+		t.Fatalf("error - expecting ErrLocalVLANUnavailable but got %v \n", err)
+	}
+	for _, localVLAN := range []uint{0, 4095} {
+		if _, err := gc.AllocVXLANWithLocalVLAN(localVLAN); err == nil {
+			t.Fatalf("error - allocated vxlan with out of range local vlan %d \n", localVLAN)
+		}
+	}
+	if free, err := gc.NumFreeVXLANs(); err != nil || free != 10 {
+		t.Fatalf("error - expecting 10 free vxlans but got %d (err: %v) \n", free, err)
+	}
+
+	if err := gc.FreeVXLANByVNI(vxlan); err != nil {
+		t.Fatalf("error freeing vxlan %d - %s \n", vxlan, err)
+	}
+	if vxlan, err := gc.AllocVXLANWithLocalVLAN(100); err != nil || vxlan != 10000 {
+		t.Fatalf("error - expecting vxlan 10000 but got %d (err: %v) \n", vxlan, err)
+	}
+}
+
+func TestResourceUsage(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-10",
+                "VXLANs"            : "10000-10010"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	for i := 0; i < 2; i++ {
+		if _, err := gc.AllocVLAN(uint(0)); err != nil {
+			t.Fatalf("error - allocating vlan - %s \n", err)
+		}
+	}
+	if _, _, err := gc.AllocVXLAN(uint(0)); err != nil {
+		t.Fatalf("error - allocating vxlan - %s \n", err)
+	}
+
+	// a resource whose oper state is missing is reported unused
+	vlanCfg := &resources.AutoVLANCfgResource{VLANs: bitset.New(10).Set(1).Set(2)}
+	vlanCfg.StateDriver = gstateSD
+	vlanCfg.ID = "other"
+	if err := vlanCfg.Write(); err != nil {
+		t.Fatalf("error writing vlan resource - %s \n", err)
+	}
+
+	usage, err := ResourceUsage(gstateSD)
+	if err != nil {
+		t.Fatalf("error getting resource usage - %s \n", err)
+	}
+	expUsage := map[string]*Usage{
+		"global": {
+			VLANs:      PoolUsage{Free: 8, Used: 2},
+			LocalVLANs: PoolUsage{Free: 4093, Used: 1},
+			VXLANs:     PoolUsage{Free: 10, Used: 1},
+		},
+		"other": {VLANs: PoolUsage{Free: 2}},
+	}
+	if !reflect.DeepEqual(usage, expUsage) {
+		t.Fatalf("error - expecting usage %+v but got %+v \n", expUsage, usage)
+	}
+}
+
+func TestCfgEqual(t *testing.T) {
+	gc := &Cfg{Auto: AutoParams{VLANs: "1-10", VXLANs: "10000-10010"}}
+	other := &Cfg{Auto: AutoParams{VLANs: "1-10", VXLANs: "10000-10010"}}
+	other.StateDriver = gstateSD
+	other.ThresholdPct = 50
+
+	if !gc.Equal(other) || gc.Hash() != other.Hash() {
+		t.Fatalf("error - configs differing only in runtime fields are not equal")
+	}
+
+	other.Auto.VLANs = "1-20"
+	if gc.Equal(other) || gc.Hash() == other.Hash() {
+		t.Fatalf("error - configs with different vlans are equal")
+	}
+
+	if gc.Equal(nil) || !(*Cfg)(nil).Equal(nil) {
+		t.Fatalf("error - unexpected result comparing nil configs")
+	}
+}
+
+func TestAllocVLANWithTTL(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-10",
+                "VXLANs"            : "10000-10010"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	if _, err := gc.AllocVLANWithTTL(0); err == nil {
+		t.Fatalf("error - expecting a zero lease to be rejected")
+	}
+
+	short, err := gc.AllocVLANWithTTL(time.Minute)
+	if err != nil {
+		t.Fatalf("error - allocating vlan with ttl - %s \n", err)
+	}
+	long, err := gc.AllocVLANWithTTL(time.Hour)
+	if err != nil {
+		t.Fatalf("error - allocating vlan with ttl - %s \n", err)
+	}
+	freed, err := gc.AllocVLANWithTTL(time.Minute)
+	if err != nil {
+		t.Fatalf("error - allocating vlan with ttl - %s \n", err)
+	}
+	plain, err := gc.AllocVLAN(uint(0))
+	if err != nil {
+		t.Fatalf("error - allocating vlan - %s \n", err)
+	}
+	if err := gc.FreeVLAN(freed); err != nil {
+		t.Fatalf("error freeing vlan - %s \n", err)
+	}
+
+	if reaped, err := gc.ReapExpired(); err != nil || len(reaped) != 0 {
+		t.Fatalf("error - expecting nothing reaped before expiry but got %v, %v \n", reaped, err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	reaped, err := gc.ReapExpired()
+	if err != nil {
+		t.Fatalf("error reaping expired vlans - %s \n", err)
+	}
+	if !reflect.DeepEqual(reaped, []uint{short}) {
+		t.Fatalf("error - expecting vlan %d reaped but got %v \n", short, reaped)
+	}
+
+	// the lease of the freed vlan is gone, so reallocating it doesn't expire
+	if vlan, err := gc.AllocVLAN(freed); err != nil || vlan != freed {
+		t.Fatalf("error - reallocating vlan %d - %d, %v \n", freed, vlan, err)
+	}
+	now = now.Add(2 * time.Hour)
+	reaped, err = gc.ReapExpired()
+	if err != nil {
+		t.Fatalf("error reaping expired vlans - %s \n", err)
+	}
+	if !reflect.DeepEqual(reaped, []uint{long}) {
+		t.Fatalf("error - expecting vlan %d reaped but got %v \n", long, reaped)
+	}
+
+	for _, vlan := range []uint{freed, plain} {
+		if _, err := gc.AllocVLAN(vlan); err == nil {
+			t.Fatalf("error - vlan %d without a lease was freed \n", vlan)
+		}
+	}
+}
+
+func TestConfigBuilder(t *testing.T) {
+	gc, err := NewConfigBuilder().Build()
+	if err != nil {
+		t.Fatalf("error building default config - %s \n", err)
+	}
+	if gc.Auto.VLANs != "1-4094" || gc.Auto.VXLANs != "1-10000" {
+		t.Fatalf("error - unexpected default ranges %+v \n", gc.Auto)
+	}
+
+	gc, err = NewConfigBuilder().
+		WithVLANRange("1-10").
+		WithVXLANRange("10000-10010").
+		WithQuota(5, 5).
+		WithStateDriver(gstateSD).
+		Build()
+	if err != nil {
+		t.Fatalf("error building config - %s \n", err)
+	}
+	expected := &Cfg{Auto: AutoParams{VLANs: "1-10", VXLANs: "10000-10010"}, Quota: Quota{MaxVLANs: 5, MaxVXLANs: 5}}
+	if !gc.Equal(expected) || gc.StateDriver != gstateSD {
+		t.Fatalf("error - unexpected config %+v \n", gc)
+	}
+
+	if _, err := NewConfigBuilder().WithVLANRange("0-10").Build(); err == nil {
+		t.Fatalf("error - expecting a reserved vlan range to be rejected")
+	}
+	if _, err := NewConfigBuilder().WithVXLANRange("abc").Build(); err == nil {
+		t.Fatalf("error - expecting an invalid vxlan range to be rejected")
+	}
+}
+
+func TestPeek(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-2",
+                "VXLANs"            : "10000-10001"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	for i := 0; i < 2; i++ {
+		peekVLAN, ok := gc.PeekVLAN()
+		if !ok {
+			t.Fatalf("error - expecting a vlan to peek")
+		}
+		if again, _ := gc.PeekVLAN(); again != peekVLAN {
+			t.Fatalf("error - peeking changed the next vlan from %d to %d \n", peekVLAN, again)
+		}
+		vlan, err := gc.AllocVLAN(uint(0))
+		if err != nil || vlan != peekVLAN {
+			t.Fatalf("error - peeked vlan %d but allocated %d, %v \n", peekVLAN, vlan, err)
+		}
+
+		peekVXLAN, peekLocalVLAN, ok := gc.PeekVXLAN()
+		if !ok {
+			t.Fatalf("error - expecting a vxlan to peek")
+		}
+		vxlan, localVLAN, err := gc.AllocVXLAN(uint(0))
+		if err != nil || vxlan != peekVXLAN || localVLAN != peekLocalVLAN {
+			t.Fatalf("error - peeked vxlan %d/%d but allocated %d/%d, %v \n",
+				peekVXLAN, peekLocalVLAN, vxlan, localVLAN, err)
+		}
+	}
+
+	if _, ok := gc.PeekVLAN(); ok {
+		t.Fatalf("error - peeked a vlan from an exhausted pool")
+	}
+	if _, _, ok := gc.PeekVXLAN(); ok {
+		t.Fatalf("error - peeked a vxlan from an exhausted pool")
+	}
+}
+
+func TestReservedVLANs(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-3",
+                "VXLANs"            : "10000-10002",
+                "reservedVLANs"     : [1]
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	for _, expected := range []uint{2, 3} {
+		vlan, err := gc.AllocVLAN(uint(0))
+		if err != nil || vlan != expected {
+			t.Fatalf("error - expecting vlan %d but got %d, %v \n", expected, vlan, err)
+		}
+		_, localVLAN, err := gc.AllocVXLAN(uint(0))
+		if err != nil || localVLAN != expected {
+			t.Fatalf("error - expecting local vlan %d but got %d, %v \n", expected, localVLAN, err)
+		}
+	}
+	if _, err := gc.AllocVLAN(uint(1)); err == nil {
+		t.Fatalf("error - allocated reserved vlan 1")
+	}
+	if _, err := gc.AllocVXLANWithLocalVLAN(1); err == nil {
+		t.Fatalf("error - allocated reserved local vlan 1")
+	}
+
+	// vlans in use can't be reserved
+	gc.Auto.ReservedVLANs = []uint{1, 2}
+	if err := gc.ValidateUpdate("vlan"); err == nil {
+		t.Fatalf("error - expecting reserving vlan 2 in use to fail")
+	}
+
+	gc.Auto.ReservedVLANs = []uint{4096}
+	if err := ValidateConfig(gc); err == nil {
+		t.Fatalf("error - expecting reserved vlan 4096 to be rejected")
+	}
+}
+
+func TestJSONKeys(t *testing.T) {
+	gc := &Cfg{Auto: AutoParams{VLANs: "1-10"}}
+	out, err := json.Marshal(gc)
+	if err != nil {
+		t.Fatalf("error marshaling config - %s \n", err)
+	}
+	if expected := `{"id":"","auto":{"vlans":"1-10"},"quota":{}}`; string(out) != expected {
+		t.Fatalf("error - expecting config %s but got %s \n", expected, out)
+	}
+
+	g := &Oper{FreeVXLANsStart: 10000, VXLANRangeMin: 10000, VXLANRangeMax: 10010}
+	out, err = json.Marshal(g)
+	if err != nil {
+		t.Fatalf("error marshaling oper state - %s \n", err)
+	}
+	expected := `{"id":"","freeVXLANsStart":10000,"vxlanRangeMin":10000,"vxlanRangeMax":10010}`
+	if string(out) != expected {
+		t.Fatalf("error - expecting oper state %s but got %s \n", expected, out)
+	}
+
+	// state written with the older keys still reads
+	gc = &Cfg{}
+	if err := json.Unmarshal([]byte(`{"auto":{"VLANs":"1-10","VXLANs":"10000-10010"}}`), gc); err != nil {
+		t.Fatalf("error unmarshaling config - %s \n", err)
+	}
+	if gc.Auto.VLANs != "1-10" || gc.Auto.VXLANs != "10000-10010" {
+		t.Fatalf("error - unexpected config %+v read from the older keys \n", gc.Auto)
+	}
+}
+
+func TestSetVLANs(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-10",
+                "VXLANs"            : "10000-10010"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	if _, err := gc.AllocVLAN(uint(2)); err != nil {
+		t.Fatalf("error - allocating vlan - %s \n", err)
+	}
+
+	err := gc.SetVLANs([]uint{2, 3, 3, 20, 5})
+	if err == nil || !strings.Contains(err.Error(), "vlan 20") {
+		t.Fatalf("error - expecting vlan 20 to fail but got %v \n", err)
+	}
+	if strings.Contains(err.Error(), "vlan 2:") || strings.Contains(err.Error(), "vlan 3:") {
+		t.Fatalf("error - expecting vlans in use to be skipped but got %v \n", err)
+	}
+
+	for _, vlan := range []uint{2, 3, 5} {
+		if _, err := gc.AllocVLAN(vlan); err == nil {
+			t.Fatalf("error - vlan %d was not claimed \n", vlan)
+		}
+	}
+	if vlan, err := gc.AllocVLAN(uint(0)); err != nil || vlan != 1 {
+		t.Fatalf("error - expecting vlan 1 but got %d, %v \n", vlan, err)
+	}
+}
+
+func TestGetStatus(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-10",
+                "VXLANs"            : "10000-10010"
+            },
+            "Quota" : {
+                "MaxVLANs"          : 5
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	if _, err := GetStatus(gstateSD); err == nil {
+		t.Fatalf("error - expecting a missing global config to fail")
+	}
+	if err := gc.Write(); err != nil {
+		t.Fatalf("error writing config - %s \n", err)
+	}
+	if _, err := gc.AllocVLAN(uint(0)); err != nil {
+		t.Fatalf("error - allocating vlan - %s \n", err)
+	}
+	if _, _, err := gc.AllocVXLAN(uint(0)); err != nil {
+		t.Fatalf("error - allocating vxlan - %s \n", err)
+	}
+
+	status, err := GetStatus(gstateSD)
+	if err != nil {
+		t.Fatalf("error getting status - %s \n", err)
+	}
+	expected := &Status{
+		VLANRanges:  []netutils.TagRange{{Min: 1, Max: 10}},
+		VXLANRanges: []netutils.TagRange{{Min: 10000, Max: 10010}},
+		Quota:       Quota{MaxVLANs: 5},
+		Usage: Usage{
+			VLANs:      PoolUsage{Free: 9, Used: 1},
+			LocalVLANs: PoolUsage{Free: 4093, Used: 1},
+			VXLANs:     PoolUsage{Free: 10, Used: 1},
+		},
+	}
+	if !reflect.DeepEqual(status, expected) {
+		t.Fatalf("error - expecting status %+v but got %+v \n", expected, status)
+	}
+}
+
+func TestVLANOnlyConfig(t *testing.T) {
+	gc, err := Parse([]byte(`{"Auto" : {"VLANs" : "1-10"}}`))
+	if err != nil {
+		t.Fatalf("error parsing config - %s \n", err)
+	}
+
+	gstateSD.Init(nil)
+	defer gstateSD.Deinit()
+	gc.StateDriver = gstateSD
+	if _, err := resources.NewStateResourceManager(gstateSD); err != nil {
+		t.Fatalf("Failed to instantiate resource manager. Error: %s", err)
+	}
+	defer resources.ReleaseStateResourceManager()
+
+	if err := gc.Process("vlan"); err != nil {
+		t.Fatalf("error processing config - %s \n", err)
+	}
+
+	vlan, err := gc.AllocVLAN(uint(0))
+	if err != nil {
+		t.Fatalf("error - allocating vlan - %s \n", err)
+	}
+	if err := gc.FreeVLAN(vlan); err != nil {
+		t.Fatalf("error freeing vlan without oper state - %s \n", err)
+	}
+	if reaped, err := gc.ReapExpired(); err != nil || len(reaped) != 0 {
+		t.Fatalf("error - expecting nothing reaped but got %v, %v \n", reaped, err)
+	}
+}
+
+func TestProcessKeepsVLANLeases(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-10",
+                "VXLANs"            : "10000-10010"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	vlan, err := gc.AllocVLANWithTTL(time.Minute)
+	if err != nil {
+		t.Fatalf("error - allocating vlan with ttl - %s \n", err)
+	}
+
+	// update the vxlan range
+	if err := gc.DeleteResources("vxlan"); err != nil {
+		t.Fatalf("error deleting vxlan resource - %s \n", err)
+	}
+	gc.Auto.VXLANs = "20000-20010"
+	if err := gc.Process("vxlan"); err != nil {
+		t.Fatalf("error processing config - %s \n", err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	reaped, err := gc.ReapExpired()
+	if err != nil || !reflect.DeepEqual(reaped, []uint{vlan}) {
+		t.Fatalf("error - expecting vlan %d reaped but got %v, %v \n", vlan, reaped, err)
+	}
+}
+
+func TestProcessDropsVLANLeases(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-10",
+                "VXLANs"            : "10000-10010"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	if vlan, err := gc.AllocVLANWithTTL(time.Minute); err != nil || vlan != 1 {
+		t.Fatalf("error - expecting vlan 1 leased but got %d, %v \n", vlan, err)
+	}
+
+	// recreating the vlan pool drops the leases of the old pool
+	if err := gc.DeleteResources("vlan"); err != nil {
+		t.Fatalf("error deleting vlan resource - %s \n", err)
+	}
+	if err := gc.Process("vlan"); err != nil {
+		t.Fatalf("error processing config - %s \n", err)
+	}
+	if vlan, err := gc.AllocVLAN(uint(0)); err != nil || vlan != 1 {
+		t.Fatalf("error - expecting vlan 1 allocated but got %d, %v \n", vlan, err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	reaped, err := gc.ReapExpired()
+	if err != nil || len(reaped) != 0 {
+		t.Fatalf("error - expecting no vlans reaped but got %v, %v \n", reaped, err)
+	}
+	vlanOper, err := gc.readVLANOper()
+	if err != nil {
+		t.Fatalf("error reading vlan oper state - %s \n", err)
+	}
+	if vlanOper.FreeVLANs.Test(1) {
+		t.Fatalf("error - vlan 1 was freed \n")
+	}
+}
+
+func TestAllocVLANDropsStaleLease(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-10",
+                "VXLANs"            : "10000-10010"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	// a lease of a vlan that is free again, e.g. left by an older version
+	if err := gc.setVLANLease(1, time.Minute); err != nil {
+		t.Fatalf("error setting vlan lease - %s \n", err)
+	}
+	if vlan, err := gc.AllocVLAN(uint(0)); err != nil || vlan != 1 {
+		t.Fatalf("error - expecting vlan 1 allocated but got %d, %v \n", vlan, err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	reaped, err := gc.ReapExpired()
+	if err != nil || len(reaped) != 0 {
+		t.Fatalf("error - expecting no vlans reaped but got %v, %v \n", reaped, err)
+	}
+}
+
+func TestFreeVXLANTwice(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-10",
+                "VXLANs"            : "10000-10010"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	vxlan, localVLAN, err := gc.AllocVXLAN(uint(0))
+	if err != nil {
+		t.Fatalf("error - allocating vxlan - %s \n", err)
+	}
+	if err := gc.FreeVXLAN(vxlan, localVLAN); err != nil {
+		t.Fatalf("error freeing vxlan - %s \n", err)
+	}
+	_, reused, err := gc.AllocVXLAN(uint(10005))
+	if err != nil || reused != localVLAN {
+		t.Fatalf("error - expecting local vlan %d reused but got %d, %v \n", localVLAN, reused, err)
+	}
+
+	if err := gc.FreeVXLANs([]VXLANLocalVLAN{{VXLAN: vxlan, LocalVLAN: localVLAN}}); err != nil {
+		t.Fatalf("error freeing an already free vxlan - %s \n", err)
+	}
+	if _, next, err := gc.AllocVXLAN(uint(0)); err != nil || next == localVLAN {
+		t.Fatalf("error - local vlan %d handed out twice (%v) \n", next, err)
+	}
+}
+
+func TestThresholdCallbackQueriesPool(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-10",
+                "VXLANs"            : "10000-10003"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	freeVLANs := uint(0)
+	gc.ThresholdPct = 100
+	gc.OnThreshold = func(resource string, pct float64) {
+		freeVLANs, _ = gc.NumFreeVLANs()
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := gc.AllocVLAN(uint(0))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("error - allocating vlan - %s \n", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("error - allocation deadlocked on the threshold callback")
+	}
+	if freeVLANs != 9 {
+		t.Fatalf("error - expecting 9 free vlans in the callback but got %d \n", freeVLANs)
+	}
+}
+
+// poolObserver queries the vlan pool on every event.
+type poolObserver struct {
+	gc        *Cfg
+	freeVLANs []uint
+}
+
+func (o *poolObserver) Notify(ev Event) {
+	free, _ := o.gc.NumFreeVLANs()
+	o.freeVLANs = append(o.freeVLANs, free)
+}
+
+func TestObserverQueriesPool(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-10",
+                "VXLANs"            : "10000-10003"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	observer := &poolObserver{gc: gc}
+	gc.Observer = observer
+
+	done := make(chan error)
+	go func() {
+		vlan, err := gc.AllocVLAN(uint(0))
+		if err == nil {
+			err = gc.FreeVLAN(vlan)
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("error - allocating and freeing vlan - %s \n", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("error - allocation deadlocked on the observer")
+	}
+	if !reflect.DeepEqual(observer.freeVLANs, []uint{9, 10}) {
+		t.Fatalf("error - unexpected free vlans seen by the observer %v \n", observer.freeVLANs)
+	}
+}
+
+func TestSerializerAllocations(t *testing.T) {
+	gc, err := Parse([]byte(`{"Auto" : {"VLANs" : "1-10", "VXLANs" : "10000-10010"}}`))
+	if err != nil {
+		t.Fatalf("error parsing config - %s \n", err)
+	}
+	gc.Serializer = base64Serializer
+
+	gstateSD.Init(nil)
+	defer gstateSD.Deinit()
+	gc.StateDriver = gstateSD
+	if _, err := resources.NewStateResourceManager(gstateSD); err != nil {
+		t.Fatalf("Failed to instantiate resource manager. Error: %s", err)
+	}
+	defer resources.ReleaseStateResourceManager()
+
+	for _, res := range []string{"vlan", "vxlan"} {
+		if err := gc.Process(res); err != nil {
+			t.Fatalf("error processing config - %s \n", err)
+		}
+	}
+	vxlan, localVLAN, err := gc.AllocVXLAN(uint(0))
+	if err != nil {
+		t.Fatalf("error - allocating vxlan - %s \n", err)
+	}
+	if _, err := gc.AssignDefaultNetwork("orange"); err != nil {
+		t.Fatalf("error assigning default network - %s \n", err)
+	}
+
+	raw, err := gstateSD.Read(OperKey())
+	if err != nil {
+		t.Fatalf("error reading raw oper state - %s \n", err)
+	}
+	if json.Valid(raw) {
+		t.Fatalf("error - oper state stored as plain JSON %s \n", raw)
+	}
+	g := &Oper{Serializer: base64Serializer}
+	g.StateDriver = gstateSD
+	if err := g.Read(""); err != nil {
+		t.Fatalf("error reading oper state - %s \n", err)
+	}
+	if g.VXLANLocalVLANs[vxlan] != localVLAN || g.DefaultNetwork != "orange" {
+		t.Fatalf("error - unexpected oper state %+v \n", g)
+	}
+}
+
+func TestReleaseSetVXLAN(t *testing.T) {
+	cfgData := []byte(`
+        {
+            "Auto" : {
+                "VLANs"             : "1-10",
+                "VXLANs"            : "10000-10010"
+            }
+        }`)
+
+	gc, cleanup := setupGlobalConfig(t, cfgData)
+	defer cleanup()
+
+	freeLocal, _, err := (&Oper{CommonState: gc.CommonState}).LocalVLANRange()
+	if err != nil {
+		t.Fatalf("error getting local vlan range - %s \n", err)
+	}
+
+	if err := gc.SetVXLAN(10003); err != nil {
+		t.Fatalf("error reserving vxlan - %s \n", err)
+	}
+	if err := gc.FreeVXLANByVNI(10003); err != nil {
+		t.Fatalf("error releasing reserved vxlan by vni - %s \n", err)
+	}
+	if numFree, _ := gc.NumFreeVXLANs(); numFree != 11 {
+		t.Fatalf("error - expecting 11 free vxlans but got %d \n", numFree)
+	}
+
+	if err := gc.SetVXLAN(10003); err != nil {
+		t.Fatalf("error reserving vxlan - %s \n", err)
+	}
+	if err := gc.FreeVXLAN(10003, 5); err == nil {
+		t.Fatalf("error - released reserved vxlan with local vlan 5")
+	}
+	if err := gc.FreeVXLAN(10003, 0); err != nil {
+		t.Fatalf("error releasing reserved vxlan - %s \n", err)
+	}
+	if numFree, _ := gc.NumFreeVXLANs(); numFree != 11 {
+		t.Fatalf("error - expecting 11 free vxlans but got %d \n", numFree)
+	}
+
+	// no local vlan was taken or returned
+	if free, _, _ := (&Oper{CommonState: gc.CommonState}).LocalVLANRange(); free != freeLocal {
+		t.Fatalf("error - expecting %d free local vlans but got %d \n", freeLocal, free)
+	}
+}
+
+// failingStateDriver fails the first write to failKey.
+type failingStateDriver struct {
+	state.FakeStateDriver
+	failKey string
+}
+
+func (d *failingStateDriver) WriteState(key string, value core.State,
+	marshal func(interface{}) ([]byte, error)) error {
+	if key == d.failKey {
+		d.failKey = ""
+		return errors.New("write failed")
+	}
+	return d.FakeStateDriver.WriteState(key, value, marshal)
+}
+
+func TestApplyConfigRestoresOnFailure(t *testing.T) {
+	d := &failingStateDriver{}
+	d.Init(nil)
+	defer d.Deinit()
+	if _, err := resources.NewStateResourceManager(d); err != nil {
+		t.Fatalf("Failed to instantiate resource manager. Error: %s", err)
+	}
+	defer resources.ReleaseStateResourceManager()
+
+	gc, err := Parse([]byte(`{"Auto" : {"VLANs" : "1-10", "VXLANs" : "10000-10010"}}`))
+	if err != nil {
+		t.Fatalf("error parsing config - %s \n", err)
+	}
+	gc.StateDriver = d
+	for _, res := range []string{"vlan", "vxlan"} {
+		if err := gc.Process(res); err != nil {
+			t.Fatalf("error processing config - %s \n", err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := gc.AllocVLAN(uint(0)); err != nil {
+			t.Fatalf("error - allocating vlan - %s \n", err)
+		}
+		if _, _, err := gc.AllocVXLAN(uint(0)); err != nil {
+			t.Fatalf("error - allocating vxlan - %s \n", err)
+		}
+	}
+
+	// defining the new resource fails after the old one was deleted
+	gc.Auto.VLANs = "1-20"
+	d.failKey = mastercfg.StateOperPath + resources.AutoVLANResource + "/global"
+	if err := gc.ApplyConfig("vlan"); err == nil {
+		t.Fatalf("error - expecting the vlan update to fail")
+	}
+	gc.Auto.VXLANs = "10000-10020"
+	d.failKey = mastercfg.StateOperPath + resources.AutoVXLANResource + "/global"
+	if err := gc.ApplyConfig("vxlan"); err == nil {
+		t.Fatalf("error - expecting the vxlan update to fail")
+	}
+
+	if free, _ := gc.NumFreeVLANs(); free != 7 {
+		t.Fatalf("error - expecting 7 free vlans after the failed update but got %d \n", free)
+	}
+	if total, _ := gc.NumTotalVLANs(); total != 10 {
+		t.Fatalf("error - expecting the 10 original vlans but got %d \n", total)
+	}
+	if free, _ := gc.NumFreeVXLANs(); free != 8 {
+		t.Fatalf("error - expecting 8 free vxlans after the failed update but got %d \n", free)
+	}
+	if _, err := gc.AllocVLAN(uint(1)); err == nil {
+		t.Fatalf("error - allocated vlan 1 twice after the failed update")
+	}
+	if err := gc.FreeVXLANByVNI(10000); err != nil {
+		t.Fatalf("error freeing vxlan after the failed update - %s \n", err)
+	}
+}
+
+// slowStateDriver serializes access to the fake driver and delays reads,
+// widening the window of read-modify-write races.
+type slowStateDriver struct {
+	state.FakeStateDriver
+	mu sync.Mutex
+}
+
+func (d *slowStateDriver) ReadState(key string, value core.State,
+	unmarshal func([]byte, interface{}) error) error {
+	time.Sleep(100 * time.Microsecond)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.FakeStateDriver.ReadState(key, value, unmarshal)
+}
+
+func (d *slowStateDriver) WriteState(key string, value core.State,
+	marshal func(interface{}) ([]byte, error)) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.FakeStateDriver.WriteState(key, value, marshal)
+}
+
+func (d *slowStateDriver) ClearState(key string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.FakeStateDriver.ClearState(key)
+}
+
+func TestConcurrentAssignAndAlloc(t *testing.T) {
+	d := &slowStateDriver{}
+	d.Init(nil)
+	defer d.Deinit()
+	if _, err := resources.NewStateResourceManager(d); err != nil {
+		t.Fatalf("Failed to instantiate resource manager. Error: %s", err)
+	}
+	defer resources.ReleaseStateResourceManager()
+
+	gc, err := Parse([]byte(`{"Auto" : {"VLANs" : "1-10", "VXLANs" : "10000-10100"}}`))
+	if err != nil {
+		t.Fatalf("error parsing config - %s \n", err)
+	}
+	gc.StateDriver = d
+	for _, res := range []string{"vlan", "vxlan"} {
+		if err := gc.Process(res); err != nil {
+			t.Fatalf("error processing config - %s \n", err)
+		}
+	}
+
+	const count = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*count)
+	for i := 0; i < count; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if _, _, err := gc.AllocVXLAN(uint(0)); err != nil {
+				errs <- err
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("net%d", i)
+			if _, err := gc.AssignDefaultNetwork(name); err != nil {
+				errs <- err
+			}
+			if err := gc.UnassignNetwork(name); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("error - concurrent operation failed - %s \n", err)
+	}
+
+	g := &Oper{}
+	g.StateDriver = d
+	if err := g.Read(""); err != nil {
+		t.Fatalf("error reading oper state - %s \n", err)
+	}
+	if len(g.VXLANLocalVLANs) != count {
+		t.Fatalf("error - expecting %d vxlan mappings but got %d \n", count, len(g.VXLANLocalVLANs))
+	}
+	if problems := g.SelfCheck(); len(problems) != 0 {
+		t.Fatalf("error - unexpected inconsistencies %v \n", problems)
+	}
+}
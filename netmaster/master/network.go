@@ -118,17 +118,14 @@ func CreateNetwork(network intent.ConfigNetwork, stateDriver core.StateDriver, t
 	nwCfg.StateDriver = stateDriver
 
 	// Allocate pkt tags
-	reqPktTag := uint(network.PktTag)
-	if nwCfg.PktTagType == "vlan" {
-		pktTag, err = gCfg.AllocVLAN(reqPktTag)
-		if err != nil {
-			return err
-		}
-	} else if nwCfg.PktTagType == "vxlan" {
-		extPktTag, pktTag, err = gCfg.AllocVXLAN(reqPktTag)
-		if err != nil {
-			return err
-		}
+	tag, localVLAN, isVXLAN, err := gCfg.AllocNetworkTag(nwCfg.PktTagType, uint(network.PktTag))
+	if err != nil {
+		return err
+	}
+	if isVXLAN {
+		extPktTag, pktTag = tag, localVLAN
+	} else {
+		pktTag = tag
 	}
 
 	nwCfg.ExtPktTag = int(extPktTag)
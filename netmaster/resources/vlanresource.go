@@ -32,6 +32,13 @@ const (
 	AutoVLANResource = "auto-vlan"
 )
 
+var (
+	// ErrVLANUnavailable is returned when a requested vlan is already in use.
+	ErrVLANUnavailable = errors.New("requested vlan not available")
+	// ErrVLANExhausted is returned when no vlans are left to allocate.
+	ErrVLANExhausted = errors.New("no vlans available")
+)
+
 const (
 	vLANResourceConfigPathPrefix = mastercfg.StateConfigPath + AutoVLANResource + "/"
 	vLANResourceConfigPath       = vLANResourceConfigPathPrefix + "%s"
@@ -192,13 +199,13 @@ func (r *AutoVLANCfgResource) Allocate(reqVal interface{}) (interface{}, error)
 	if (reqVal != nil) && (reqVal.(uint) != 0) {
 		vlan = reqVal.(uint)
 		if !oper.FreeVLANs.Test(vlan) {
-			return nil, errors.New("requested vlan not available")
+			return nil, ErrVLANUnavailable
 		}
 	} else {
 		ok := false
 		vlan, ok = oper.FreeVLANs.NextSet(0)
 		if !ok {
-			return nil, errors.New("no vlans available")
+			return nil, ErrVLANExhausted
 		}
 	}
 	oper.FreeVLANs.Clear(vlan)
@@ -32,6 +32,19 @@ const (
 	AutoVXLANResource = "auto-vxlan"
 )
 
+var (
+	// ErrVXLANUnavailable is returned when a requested vxlan is already in use.
+	ErrVXLANUnavailable = errors.New("requested vxlan not available")
+	// ErrVXLANExhausted is returned when no vxlans are left to allocate.
+	ErrVXLANExhausted = errors.New("no vxlans available")
+	// ErrLocalVLANUnavailable is returned when a requested local vlan is
+	// already in use.
+	ErrLocalVLANUnavailable = errors.New("requested local vlan not available")
+	// ErrLocalVLANExhausted is returned when no local vlans are left to
+	// allocate.
+	ErrLocalVLANExhausted = errors.New("no local vlans available")
+)
+
 const (
 	vXLANResourceConfigPathPrefix = mastercfg.StateConfigPath + AutoVXLANResource + "/"
 	vXLANResourceConfigPath       = vXLANResourceConfigPathPrefix + "%s"
@@ -188,25 +201,43 @@ func (r *AutoVXLANCfgResource) Allocate(reqVal interface{}) (interface{}, error)
 		return nil, err
 	}
 
-	var vxlan uint
-	if (reqVal != nil) && (reqVal.(uint) != 0) {
-		vxlan = reqVal.(uint)
+	// the requested value is either a vxlan or a vxlan-vlan pair; zero
+	// values are allocated from the free pool.
+	var vxlan, vlan uint
+	switch req := reqVal.(type) {
+	case uint:
+		vxlan = req
+	case VXLANVLANPair:
+		vxlan = req.VXLAN
+		vlan = req.VLAN
+	}
+
+	if vxlan != 0 {
 		if !oper.FreeVXLANs.Test(vxlan) {
-			return nil, errors.New("requested vxlan not available")
+			return nil, ErrVXLANUnavailable
 		}
 	} else {
 		ok := false
 		vxlan, ok = oper.FreeVXLANs.NextSet(0)
 		if !ok {
-			return nil, errors.New("no vxlans available")
+			return nil, ErrVXLANExhausted
 		}
 	}
 
-	vlan, ok := oper.FreeLocalVLANs.NextSet(0)
-	if !ok {
-		return nil, errors.New("no local vlans available")
+	if vlan != 0 {
+		if !oper.FreeLocalVLANs.Test(vlan) {
+			return nil, ErrLocalVLANUnavailable
+		}
+	} else {
+		ok := false
+		vlan, ok = oper.FreeLocalVLANs.NextSet(0)
+		if !ok {
+			return nil, ErrLocalVLANExhausted
+		}
 	}
 
+	// both values are known to be free at this point; nothing is consumed
+	// if either of them is not available.
 	oper.FreeVXLANs.Clear(vxlan)
 	oper.FreeLocalVLANs.Clear(vlan)
 
@@ -16,10 +16,13 @@ limitations under the License.
 package netutils
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"math"
 	"math/big"
+	"math/bits"
 	"net"
 	"os"
 	"strconv"
@@ -220,6 +223,45 @@ func CreateBitset(numBitsWide uint) *bitset.BitSet {
 	return bitset.New(uint(maxSize))
 }
 
+// PrevSet returns the highest set bit at or below i, scanning a word at a
+// time. The bitset does not expose its words, so they are read back from
+// its binary form.
+func PrevSet(b *bitset.BitSet, i uint) (uint, bool) {
+	buf := &bytes.Buffer{}
+	if _, err := b.WriteTo(buf); err != nil {
+		return 0, false
+	}
+
+	var length uint64
+	if err := binary.Read(buf, binary.BigEndian, &length); err != nil {
+		return 0, false
+	}
+	words := make([]uint64, buf.Len()/8)
+	if err := binary.Read(buf, binary.BigEndian, words); err != nil {
+		return 0, false
+	}
+
+	if length == 0 {
+		return 0, false
+	}
+	if uint64(i) >= length {
+		i = uint(length - 1)
+	}
+
+	idx := int(i / 64)
+	word := words[idx] & (^uint64(0) >> (63 - i%64))
+	for {
+		if word != 0 {
+			return uint(idx*64 + bits.Len64(word) - 1), true
+		}
+		idx--
+		if idx < 0 {
+			return 0, false
+		}
+		word = words[idx]
+	}
+}
+
 func ipv4ToUint32(ipaddr string) (uint32, error) {
 	var ipUint32 uint32
 
@@ -466,10 +508,6 @@ func ParseTagRanges(ranges string, tagType string) ([]TagRange, error) {
 	}
 	rangesStr := strings.Split(ranges, ",")
 
-	if len(rangesStr) > 1 && tagType == "vxlan" {
-		return nil, core.Errorf("do not support more than 2 vxlan tag ranges")
-	}
-
 	tagRanges := make([]TagRange, len(rangesStr), len(rangesStr))
 	for idx, oneRangeStr := range rangesStr {
 		oneRangeStr = strings.Trim(oneRangeStr, " ")
@@ -512,6 +550,24 @@ func ParseTagRanges(ranges string, tagType string) ([]TagRange, error) {
 		}
 	}
 
+	// multiple vxlan ranges are mapped relative to the lowest vxlan, so the
+	// overall span is subject to the same limit as a single range
+	if tagType == "vxlan" && len(tagRanges) > 1 {
+		min, max := tagRanges[0].Min, tagRanges[0].Max
+		for _, tagRange := range tagRanges[1:] {
+			if tagRange.Min < min {
+				min = tagRange.Min
+			}
+			if tagRange.Max > max {
+				max = tagRange.Max
+			}
+		}
+		if max-min > 16000 {
+			return nil, core.Errorf("does not allow vxlan ranges to span more than 16000 %s",
+				ranges)
+		}
+	}
+
 	return tagRanges, nil
 }
 
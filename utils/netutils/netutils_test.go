@@ -262,11 +262,19 @@ func TestValidVxlanRange(t *testing.T) {
 	}
 }
 
-func TestInvalidVxlanMultipleRanges(t *testing.T) {
+func TestValidVxlanMultipleRanges(t *testing.T) {
 	rangeStr := "101-400, 10000-15000"
 	_, err := ParseTagRanges(rangeStr, "vxlan")
+	if err != nil {
+		t.Fatalf("error '%s' parsing valid vxlan ranges '%s'\n", err, rangeStr)
+	}
+}
+
+func TestInvalidVxlanMultipleRangesSpan(t *testing.T) {
+	rangeStr := "101-400, 20000-25000"
+	_, err := ParseTagRanges(rangeStr, "vxlan")
 	if err == nil {
-		t.Fatalf("successfully parsed invalid vxlan value '%s'\n", rangeStr)
+		t.Fatalf("successfully parsed vxlan ranges spanning more than 16000 '%s'\n", rangeStr)
 	}
 }
 
@@ -350,3 +358,35 @@ func TestGetAddrList(t *testing.T) {
 
 	fmt.Printf("Got local address list: %v\n", addrList)
 }
+
+func TestPrevSet(t *testing.T) {
+	b := CreateBitset(12)
+	for _, i := range []uint{0, 63, 64, 200, 4094} {
+		b.Set(i)
+	}
+
+	for _, te := range []struct {
+		from  uint
+		found bool
+		exp   uint
+	}{
+		{5000, true, 4094},
+		{4094, true, 4094},
+		{4093, true, 200},
+		{199, true, 64},
+		{64, true, 64},
+		{63, true, 63},
+		{62, true, 0},
+	} {
+		bit, found := PrevSet(b, te.from)
+		if found != te.found || bit != te.exp {
+			t.Fatalf("PrevSet from %d returned %d (found: %v), expected %d \n",
+				te.from, bit, found, te.exp)
+		}
+	}
+
+	b.Clear(0)
+	if bit, found := PrevSet(b, 62); found {
+		t.Fatalf("PrevSet from 62 returned %d from an empty range \n", bit)
+	}
+}